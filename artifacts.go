@@ -0,0 +1,250 @@
+package qmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/goware/lg"
+
+	"github.com/pressly/qmd/config"
+	"github.com/pressly/qmd/rest/api"
+)
+
+// ArtifactStore persists artifacts of the finished jobs, i.e. the files
+// the scripts leave in $QMD_TMP/artifacts/ or declare in their manifests.
+type ArtifactStore interface {
+	// Save stores the job's artifact for logTTL seconds.
+	Save(ID string, name string, r io.Reader) error
+	// List returns the job's artifacts sorted by name.
+	List(ID string) ([]api.Artifact, error)
+	// Open returns the job's artifact and its size, or ErrNotFound.
+	Open(ID string, name string) (io.ReadCloser, int64, error)
+	// Sweep removes the expired artifacts.
+	Sweep() error
+}
+
+// NewArtifactStore creates ArtifactStore backend specified in config.
+// It returns nil ArtifactStore if the file backend has no directory.
+func NewArtifactStore(conf *config.Config) (ArtifactStore, error) {
+	switch conf.Artifacts.Backend {
+	case "", "file":
+		dir := conf.Artifacts.Dir
+		if dir == "" && conf.StoreDir != "" {
+			dir = filepath.Join(privateDir(conf.StoreDir), "artifacts")
+		}
+		if dir == "" {
+			return nil, nil
+		}
+		return NewFileArtifactStore(dir)
+	}
+	return nil, fmt.Errorf("artifacts: unknown backend \"%v\"", conf.Artifacts.Backend)
+}
+
+// FileArtifactStore is an ArtifactStore keeping the artifacts in a local
+// directory, in <ID>/<name> files. The artifacts are available only on
+// the node that ran the job.
+type FileArtifactStore struct {
+	dir string
+	ttl time.Duration
+}
+
+func NewFileArtifactStore(dir string) (*FileArtifactStore, error) {
+	if dir == "" {
+		return nil, errors.New("artifacts: dir must be set for the file backend")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileArtifactStore{
+		dir: dir,
+		ttl: time.Duration(logTTL) * time.Second,
+	}, nil
+}
+
+func (s *FileArtifactStore) Save(ID string, name string, r io.Reader) error {
+	file, err := s.file(ID, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so the readers never
+	// see partially written artifact.
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (s *FileArtifactStore) List(ID string) ([]api.Artifact, error) {
+	dir, err := s.file(ID, "")
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts := []api.Artifact{}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") || !info.Mode().IsRegular() {
+			continue
+		}
+		artifacts = append(artifacts, api.Artifact{Name: info.Name(), Size: info.Size()})
+	}
+	sort.Sort(byArtifactName(artifacts))
+	return artifacts, nil
+}
+
+func (s *FileArtifactStore) Open(ID string, name string) (io.ReadCloser, int64, error) {
+	file, err := s.file(ID, name)
+	if err != nil {
+		return nil, 0, ErrNotFound
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (s *FileArtifactStore) Sweep() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if time.Since(info.ModTime()) > s.ttl {
+			if err := os.RemoveAll(filepath.Join(s.dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// file returns path to the job's artifact, or the job's directory
+// if name is empty. It refuses IDs and names that could escape it.
+func (s *FileArtifactStore) file(ID string, name string) (string, error) {
+	if !validArtifactName(ID) {
+		return "", errors.New("artifacts: invalid job ID \"" + ID + "\"")
+	}
+	if name != "" && !validArtifactName(name) {
+		return "", errors.New("artifacts: invalid name \"" + name + "\"")
+	}
+	return filepath.Join(s.dir, ID, name), nil
+}
+
+func validArtifactName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".")
+}
+
+type byArtifactName []api.Artifact
+
+func (s byArtifactName) Len() int           { return len(s) }
+func (s byArtifactName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byArtifactName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// artifactsDir is the directory in QMD_TMP for the scripts' artifacts.
+const artifactsDir = "artifacts"
+
+// saveArtifacts persists the cmd's artifacts, i.e. the files in
+// $QMD_TMP/artifacts/ and the files matching the script's manifest,
+// before the cmd's working directory is removed. Only the regular files
+// within QMD_TMP are saved, under their base names.
+func (qmd *Qmd) saveArtifacts(cmd *Cmd, script string) []api.Artifact {
+	if qmd.Artifacts == nil {
+		return nil
+	}
+	dir, err := filepath.EvalSymlinks(cmd.Cmd.Dir)
+	if err != nil {
+		return nil
+	}
+
+	var files []string
+	if infos, err := ioutil.ReadDir(filepath.Join(dir, artifactsDir)); err == nil {
+		for _, info := range infos {
+			files = append(files, filepath.Join(dir, artifactsDir, info.Name()))
+		}
+	}
+	if m, _ := qmd.Scripts.Manifest(script); m != nil {
+		for _, pattern := range m.Artifacts {
+			matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+			files = append(files, matches...)
+		}
+	}
+
+	max := int64(qmd.Config.Artifacts.MaxSize) * 1024 * 1024
+	var total int64
+	var artifacts []api.Artifact
+	saved := map[string]bool{}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if saved[name] || !validArtifactName(name) {
+			continue
+		}
+
+		// Don't follow the symlinks out of QMD_TMP.
+		if parent, err := filepath.EvalSymlinks(filepath.Dir(file)); err != nil || (parent != dir && !strings.HasPrefix(parent, dir+"/")) {
+			continue
+		}
+		f, err := os.OpenFile(file, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			f.Close()
+			continue
+		}
+
+		if max > 0 && total+info.Size() > max {
+			lg.Errorf("Artifacts:\tskipped %v of job %v: artifacts exceed %v MB", name, cmd.JobID, qmd.Config.Artifacts.MaxSize)
+			f.Close()
+			continue
+		}
+		err = qmd.Artifacts.Save(cmd.JobID, name, io.LimitReader(f, info.Size()))
+		f.Close()
+		if err != nil {
+			lg.Errorf("Artifacts:\tcan't save %v of job %v: %v", name, cmd.JobID, err)
+			continue
+		}
+		saved[name] = true
+		total += info.Size()
+		artifacts = append(artifacts, api.Artifact{Name: name, Size: info.Size()})
+	}
+	sort.Sort(byArtifactName(artifacts))
+	return artifacts
+}
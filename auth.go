@@ -0,0 +1,62 @@
+package qmd
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"path"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Token is an API token with permissions.
+type Token struct {
+	Name    string   `json:"name"`
+	Scripts []string `json:"scripts"` // Glob patterns of the scripts the token can run.
+	Jobs    bool     `json:"jobs"`    // Can read (and cancel) jobs.
+}
+
+// CanRun reports whether the token can run the script.
+func (t *Token) CanRun(script string) bool {
+	for _, pattern := range t.Scripts {
+		if ok, _ := path.Match(pattern, script); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate looks the token up in the config first and in the DB next.
+// It returns ErrUnauthorized for unknown tokens.
+func (qmd *Qmd) Authenticate(token string) (*Token, error) {
+	if token == "" {
+		return nil, ErrUnauthorized
+	}
+
+	for _, t := range qmd.Config.Auth.Tokens {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return &Token{
+				Name:    t.Name,
+				Scripts: t.Scripts,
+				Jobs:    t.Jobs,
+			}, nil
+		}
+	}
+
+	t, err := qmd.DB.GetToken(TokenHash(token))
+	if err == ErrNotFound {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// TokenHash returns hex encoded SHA-256 of the token. The DB stores
+// tokens under their hashes, not in plain text.
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,197 @@
+package qmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goware/lg"
+
+	"github.com/pressly/qmd/rest/api"
+	"github.com/pressly/qmd/signature"
+)
+
+const (
+	callbackPollInterval = 500 * time.Millisecond
+	callbackBatch        = 20
+
+	defaultCallbackMaxAttempts = 10
+	defaultCallbackBackoff     = 1    // seconds
+	defaultCallbackMaxBackoff  = 3600 // seconds
+	defaultCallbackTimeout     = 30   // seconds
+)
+
+// Callback is an entry in the outbox of the responses to be POSTed
+// to callback_url.
+type Callback struct {
+	ID          string    `json:"id"` // Job ID.
+	URL         string    `json:"url"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// SaveResponse stores the job response. If callbackURL is set, it also
+// puts the callback into the outbox, so it's delivered by DispatchCallbacks.
+func (qmd *Qmd) SaveResponse(resp *api.ScriptsResponse, callbackURL string) error {
+	if callbackURL != "" {
+		resp.Callback = &api.CallbackStatus{Status: "PENDING"}
+	}
+
+	if err := qmd.DB.SaveResponse(resp); err != nil {
+		return err
+	}
+
+	if callbackURL == "" {
+		return nil
+	}
+	return qmd.DB.SaveCallback(&Callback{
+		ID:          resp.ID,
+		URL:         callbackURL,
+		NextAttempt: time.Now(),
+	})
+}
+
+// DispatchCallbacks delivers the callbacks from the outbox, retrying
+// the failed ones with exponential backoff. Callbacks that fail
+// max_attempts times are moved to the dead-letter list.
+func (qmd *Qmd) DispatchCallbacks() {
+	qmd.WaitCallbacks.Add(1)
+	defer qmd.WaitCallbacks.Done()
+
+	lg.Debug("Callbacks:\tDispatching")
+
+	for {
+		select {
+		case <-time.After(callbackPollInterval):
+			// Claim the callbacks for a bit longer than a single delivery
+			// takes, so no other node picks them up meanwhile.
+			lease := 2 * time.Duration(orDefault(qmd.Config.Callback.Timeout, defaultCallbackTimeout)) * time.Second
+			cbs, err := qmd.DB.ClaimCallbacks(callbackBatch, lease)
+			if err != nil {
+				lg.Errorf("Callbacks:\tcan't claim callbacks: %v", err)
+				break
+			}
+
+			var wg sync.WaitGroup
+			for _, cb := range cbs {
+				wg.Add(1)
+				go func(cb *Callback) {
+					defer wg.Done()
+					qmd.deliverCallback(cb)
+				}(cb)
+			}
+			wg.Wait()
+
+		case <-qmd.ClosingCallbacks:
+			lg.Debug("Callbacks:\tStopped dispatching")
+			return
+		}
+	}
+}
+
+func (qmd *Qmd) deliverCallback(cb *Callback) {
+	data, err := qmd.DB.GetResponse(cb.ID)
+	if err != nil {
+		lg.Errorf("Callbacks:\tdropping callback of job %v: %v", cb.ID, err)
+		qmd.DB.DeleteCallback(cb.ID)
+		return
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(orDefault(qmd.Config.Callback.Timeout, defaultCallbackTimeout)) * time.Second,
+	}
+
+	cb.Attempts++
+	attempt := api.CallbackAttempt{Time: time.Now()}
+	req, err := qmd.callbackRequest(cb, data)
+	if err == nil {
+		var res *http.Response
+		res, err = client.Do(req)
+		if err == nil {
+			res.Body.Close()
+			attempt.StatusCode = res.StatusCode
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				err = fmt.Errorf("unexpected response status code %v", res.StatusCode)
+			}
+		}
+	}
+
+	var status string
+	switch {
+	case err == nil:
+		status = "DELIVERED"
+		qmd.Metrics.CallbackAttempted("delivered")
+		lg.Debugf("Callbacks:\tDelivered job %v to %v", cb.ID, cb.URL)
+		err = qmd.DB.DeleteCallback(cb.ID)
+
+	case cb.Attempts >= orDefault(qmd.Config.Callback.MaxAttempts, defaultCallbackMaxAttempts):
+		status = "FAILED"
+		qmd.Metrics.CallbackAttempted("failed")
+		attempt.Err = err.Error()
+		lg.Errorf("Callbacks:\tgiving up on job %v/jobs/%v callback to %v after %v attempts: %v", qmd.Config.URL, cb.ID, cb.URL, cb.Attempts, err)
+		err = qmd.DB.DeadLetterCallback(cb)
+
+	default:
+		status = "PENDING"
+		qmd.Metrics.CallbackAttempted("retried")
+		attempt.Err = err.Error()
+		cb.NextAttempt = time.Now().Add(qmd.callbackBackoff(cb.Attempts))
+		lg.Debugf("Callbacks:\tcan't deliver job %v to %v (attempt %v): %v", cb.ID, cb.URL, cb.Attempts, err)
+		err = qmd.DB.SaveCallback(cb)
+	}
+	if err != nil {
+		lg.Errorf("Callbacks:\tcan't update callback of job %v: %v", cb.ID, err)
+	}
+
+	// Record the attempt on the job response.
+	var resp api.ScriptsResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		lg.Errorf("Callbacks:\tcan't decode job %v: %v", cb.ID, err)
+		return
+	}
+	if resp.Callback == nil {
+		resp.Callback = &api.CallbackStatus{}
+	}
+	resp.Callback.Status = status
+	resp.Callback.Attempts = append(resp.Callback.Attempts, attempt)
+	if err := qmd.DB.UpdateResponse(&resp); err != nil {
+		lg.Errorf("Callbacks:\tcan't update job %v: %v", cb.ID, err)
+	}
+}
+
+// callbackRequest creates the POST request with the response data,
+// signed if the secret is configured.
+func (qmd *Qmd) callbackRequest(cb *Callback, data []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", cb.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := qmd.Config.Callback.Secret; secret != "" {
+		signature.SignRequest(req, []byte(secret), data)
+	}
+	return req, nil
+}
+
+// callbackBackoff returns delay before the next delivery attempt.
+func (qmd *Qmd) callbackBackoff(attempts int) time.Duration {
+	backoff := time.Duration(orDefault(qmd.Config.Callback.Backoff, defaultCallbackBackoff)) * time.Second
+	max := time.Duration(orDefault(qmd.Config.Callback.MaxBackoff, defaultCallbackMaxBackoff)) * time.Second
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+func orDefault(value int, def int) int {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
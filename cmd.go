@@ -3,48 +3,113 @@ package qmd
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/goware/lg"
+
+	"github.com/pressly/qmd/config"
+	"github.com/pressly/qmd/rest/api"
 )
 
 type Cmd struct {
 	*exec.Cmd `json:"cmd"`
 
 	JobID       string
+	Script      string
 	State       CmdState
 	StartTime   time.Time
 	EndTime     time.Time
 	Duration    time.Duration
 	StatusCode  int
+	Signal      string // Name of the signal that ended the cmd, if any.
 	CallbackURL string
 	Err         error
 	Priority    Priority
 
-	CmdOut     bytes.Buffer
-	QmdOut     bytes.Buffer
+	CmdOut     OutputBuffer // Combined stdout and stderr.
+	Stdout     OutputBuffer
+	Stderr     OutputBuffer
+	QmdOut     OutputBuffer
 	QmdOutFile string
 
+	// OutputDir is where the overflowing output is spilled,
+	// see OutputBuffer.
+	OutputDir string
+
+	// LineLog enables Lines, the timestamped log of the output lines
+	// tagged with their stream.
+	LineLog        bool
+	Lines          []api.LogLine
+	linesSize      int
+	linesTruncated bool
+
+	muOut   sync.Mutex // guards the output of the streams
+	streams []*streamWriter
+
+	// LogWriter, if set, gets a copy of the cmd's output as it's written.
+	LogWriter io.Writer
+
 	StoreDir          string
 	ExtraWorkDirFiles map[string]string
+	StagingDir        string // Uploaded files to copy to the working directory, see Staging.
+	Stdin             []byte
+
+	// Env is the cmd's environment, in addition to QMD's own or, if
+	// CleanEnv is set, to a minimal one, see environ.
+	Env      []string
+	CleanEnv bool
+
+	// KillGrace is how long Kill waits after SIGTERM, before it sends
+	// SIGKILL to the process group.
+	KillGrace time.Duration
+
+	// Resources limits the cmd's processes. The memory and cpus limits
+	// are applied through a cgroup in CgroupDir, unless it's empty.
+	Resources config.Resources
+	CgroupDir string
+	// LimitsHit lists the resource limits the cmd has hit, see limitsHit.
+	LimitsHit []string
+
+	cgroup     string   // The cmd's own cgroup, if any.
+	cgroupFile *os.File // Open cgroup, the cmd is started in.
+
+	// Credential, if set, is the user and group to run the cmd as.
+	// The user owns the cmd's QMD_TMP.
+	Credential *syscall.Credential
+
+	// Sandbox, if set, runs the cmd chrooted in new namespaces,
+	// see enterSandbox. ScriptDir is visible in the sandbox.
+	Sandbox    *config.SandboxConfig
+	ScriptDir  string
+	cloneflags uintptr
+	sandbox    *sandbox
 
 	// Started channel block until the cmd is started.
 	Started chan struct{}
 	// Finished channel block until the cmd is finished/killed/invalidated.
 	Finished chan struct{}
+	// Cancelled channel is closed when user asks to cancel the cmd.
+	Cancelled chan struct{}
 
 	// WaitOnce guards the Wait() logic, so it can be called multiple times.
 	WaitOnce sync.Once
 	// StartOnce guards the Start() logic, so it can be called multiple times.
 	StartOnce sync.Once
+	// CancelOnce guards the Cancel() logic, so it can be called multiple times.
+	CancelOnce sync.Once
 }
 
+const defaultKillGracePeriod = 10 // In seconds.
+
 type CmdState int
 
 const (
@@ -64,6 +129,18 @@ const (
 	PriorityUrgent
 )
 
+// ParsePriority returns Priority of a given name. Unknown names
+// fall back to PriorityHigh, the default priority.
+func ParsePriority(name string) Priority {
+	switch name {
+	case "low":
+		return PriorityLow
+	case "urgent":
+		return PriorityUrgent
+	}
+	return PriorityHigh
+}
+
 func (s Priority) String() string {
 	switch s {
 	case PriorityLow:
@@ -78,11 +155,31 @@ func (s Priority) String() string {
 
 func (qmd *Qmd) Cmd(from *exec.Cmd) (*Cmd, error) {
 	cmd := &Cmd{
-		Cmd:      from,
-		State:    Initialized,
-		Started:  make(chan struct{}),
-		Finished: make(chan struct{}),
-		StoreDir: qmd.Config.StoreDir,
+		Cmd:       from,
+		State:     Initialized,
+		Started:   make(chan struct{}),
+		Finished:  make(chan struct{}),
+		Cancelled: make(chan struct{}),
+		StoreDir:  qmd.Config.StoreDir,
+		KillGrace: time.Duration(orDefault(qmd.Config.KillGrace, defaultKillGracePeriod)) * time.Second,
+		CgroupDir: qmd.cgroupDir,
+		LineLog:   qmd.Config.Output.LineLog,
+		OutputDir: qmd.outputDir(),
+		CleanEnv:  qmd.Config.Env.Clean,
+	}
+	cmd.CmdOut.Max = qmd.Config.Output.MaxExecLog * 1024
+	cmd.Stdout.Max = cmd.CmdOut.Max
+	cmd.Stderr.Max = cmd.CmdOut.Max
+	cmd.QmdOut.Max = qmd.Config.Output.MaxOutput * 1024
+	if qmd.Config.Sandbox.Enabled {
+		cmd.Sandbox = &qmd.Config.Sandbox
+		cmd.ScriptDir = qmd.Config.ScriptDir
+		cmd.cloneflags = qmd.sandboxFlags
+		cmd.Credential = &syscall.Credential{
+			Uid:    uint32(qmd.Config.Sandbox.UID),
+			Gid:    uint32(qmd.Config.Sandbox.GID),
+			Groups: []uint32{},
+		}
 	}
 	cmd.Cmd.Dir = qmd.Config.WorkDir
 
@@ -103,19 +200,30 @@ func (cmd *Cmd) startOnce() {
 
 	cmd.Cmd.Dir += "/" + cmd.JobID
 	cmd.QmdOutFile = cmd.Cmd.Dir + "/QMD_OUT"
-	cmd.Cmd.Env = append(os.Environ(),
-		"QMD_TMP="+cmd.Cmd.Dir,
-		"QMD_STORE="+cmd.StoreDir,
-		"QMD_OUT="+cmd.QmdOutFile,
-	)
+	cmd.Cmd.Env = cmd.environ()
 
 	cmd.Cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
-		//TODO: Chroot: cmd.Cmd.Dir,
 	}
 
-	cmd.Cmd.Stdout = &cmd.CmdOut
-	cmd.Cmd.Stderr = &cmd.CmdOut
+	if cmd.OutputDir != "" {
+		dir := filepath.Join(cmd.OutputDir, cmd.JobID)
+		cmd.CmdOut.File = filepath.Join(dir, "exec_log")
+		cmd.Stdout.File = filepath.Join(dir, "stdout")
+		cmd.Stderr.File = filepath.Join(dir, "stderr")
+		cmd.QmdOut.File = filepath.Join(dir, "output")
+	}
+
+	if cmd.Stdin != nil {
+		cmd.Cmd.Stdin = bytes.NewReader(cmd.Stdin)
+	}
+
+	var out io.Writer = &cmd.CmdOut
+	if cmd.LogWriter != nil {
+		out = io.MultiWriter(&cmd.CmdOut, cmd.LogWriter)
+	}
+	cmd.Cmd.Stdout = cmd.newStreamWriter("stdout", &cmd.Stdout, out)
+	cmd.Cmd.Stderr = cmd.newStreamWriter("stderr", &cmd.Stderr, out)
 
 	// Create working directory.
 	err := os.MkdirAll(cmd.Cmd.Dir, 0777)
@@ -143,6 +251,33 @@ func (cmd *Cmd) startOnce() {
 		}
 	}
 
+	if cmd.StagingDir != "" {
+		if err := cmd.copyStaged(); err != nil {
+			cmd.Err = err
+			goto failedToStart
+		}
+	}
+
+	if err := cmd.limit(); err != nil {
+		cmd.Err = err
+		goto failedToStart
+	}
+
+	if cmd.Credential != nil {
+		if err := chownTree(cmd.Cmd.Dir, cmd.Credential); err != nil {
+			cmd.Err = err
+			goto failedToStart
+		}
+		cmd.Cmd.SysProcAttr.Credential = cmd.Credential
+	}
+
+	if cmd.Sandbox != nil {
+		if err := cmd.enterSandbox(); err != nil {
+			cmd.Err = err
+			goto failedToStart
+		}
+	}
+
 	if err := cmd.Cmd.Start(); err != nil {
 		cmd.Err = err
 		goto failedToStart
@@ -155,6 +290,8 @@ func (cmd *Cmd) startOnce() {
 	return
 
 failedToStart:
+	cmd.leaveSandbox()
+	cmd.removeCgroup()
 	cmd.StatusCode = -1
 	cmd.State = Failed
 	cmd.WaitOnce.Do(func() {
@@ -192,16 +329,32 @@ func (cmd *Cmd) waitOnce() {
 		if e, ok := err.(*exec.ExitError); ok {
 			if s, ok := e.Sys().(syscall.WaitStatus); ok {
 				cmd.StatusCode = s.ExitStatus()
+				if s.Signaled() {
+					cmd.Signal = signalName(s.Signal())
+				}
 			}
 		}
+		if sig := cmd.sandboxSignal(); sig != 0 {
+			cmd.StatusCode = -1
+			cmd.Signal = signalName(sig)
+		}
 	}
 
+	cmd.flushStreams()
+	cmd.CmdOut.Close()
+	cmd.Stdout.Close()
+	cmd.Stderr.Close()
+	cmd.leaveSandbox()
+	cmd.LimitsHit = cmd.limitsHit()
+	cmd.removeCgroup()
+
 	if f, err := os.Open(cmd.QmdOutFile); err == nil {
-		_, err := cmd.QmdOut.ReadFrom(f)
+		_, err := io.Copy(&cmd.QmdOut, f)
 		if err != nil {
 			cmd.Err = err
 		}
 		f.Close()
+		cmd.QmdOut.Close()
 	}
 
 	close(cmd.Finished)
@@ -233,18 +386,39 @@ func (cmd *Cmd) Kill() error {
 			cmd.Cmd.Process.Kill()
 			break
 		}
-		// Kill the whole process group.
-		syscall.Kill(-pgid, 15)
-
-	case Finished:
-		lg.Debug("Cmd:\tKilling pgroup %v\n", cmd.JobID)
-		pgid, err := syscall.Getpgid(cmd.Cmd.Process.Pid)
-		if err != nil {
+		// Kill the whole process group. Escalate to SIGKILL,
+		// if the cmd doesn't finish within the grace period.
+		syscall.Kill(-pgid, syscall.SIGTERM)
+		go func() {
+			select {
+			case <-cmd.Finished:
+			case <-time.After(cmd.KillGrace):
+				lg.Debugf("Cmd:\tKilling %v with SIGKILL", cmd.JobID)
+				syscall.Kill(-pgid, syscall.SIGKILL)
+			}
+		}()
+
+	case Finished, Terminated:
+		// Make sure to kill the whole process group, so there are no
+		// subprocesses left. The main process is gone, but it was
+		// the group leader, see Setpgid.
+		pgid := cmd.Cmd.Process.Pid
+		if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
 			break
 		}
-		// Make sure to kill the whole process group,
-		// so there are no subprocesses left.
-		syscall.Kill(-pgid, 15)
+		lg.Debugf("Cmd:\tKilling pgroup %v\n", cmd.JobID)
+		// Escalate to SIGKILL, if there are subprocesses left
+		// after the grace period.
+		go func() {
+			for deadline := time.Now().Add(cmd.KillGrace); time.Now().Before(deadline); {
+				time.Sleep(100 * time.Millisecond)
+				if err := syscall.Kill(-pgid, 0); err != nil {
+					return
+				}
+			}
+			lg.Debugf("Cmd:\tKilling pgroup %v with SIGKILL", cmd.JobID)
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		}()
 
 	case Initialized:
 		// This one is tricky, as the cmd's Start() might have
@@ -273,6 +447,14 @@ func (cmd *Cmd) Kill() error {
 	return cmd.Err
 }
 
+// Cancel asks the cmd's worker to kill the cmd. It doesn't block.
+func (cmd *Cmd) Cancel() {
+	cmd.CancelOnce.Do(func() {
+		lg.Debugf("Cmd:\tCancelling %v\n", cmd.JobID)
+		close(cmd.Cancelled)
+	})
+}
+
 func (cmd *Cmd) Cleanup() error {
 	lg.Debugf("Cmd:\tCleaning %v\n", cmd.JobID)
 
@@ -306,3 +488,30 @@ func (s CmdState) String() string {
 	}
 	panic("unreachable")
 }
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+// signalName returns name of the signal, e.g. "SIGTERM".
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
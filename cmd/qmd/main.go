@@ -39,6 +39,8 @@ func main() {
 	go app.WatchScripts()
 	go app.StartWorkers()
 	go app.ListenQueue()
+	go app.DispatchCallbacks()
+	go app.SweepJobFiles()
 
 	graceful.AddSignal(syscall.SIGINT, syscall.SIGTERM)
 	graceful.PreHook(app.Close)
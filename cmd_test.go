@@ -1,20 +1,35 @@
 package qmd_test
 
 import (
-	"log"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/pressly/qmd"
 	"github.com/pressly/qmd/config"
 )
 
+// newTestCmd returns cmd of the job running the bash script.
+func newTestCmd(t *testing.T, Qmd *qmd.Qmd, jobID string, script string) *qmd.Cmd {
+	cmd, err := Qmd.Cmd(exec.Command("bash", "-c", script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.JobID = jobID
+	return cmd
+}
+
 func TestStartWaitJob(t *testing.T) {
 	run := exec.Command("bash", "-c", "echo -n stdout; echo -n stderr >&2; echo -n result >$QMD_OUT")
 
 	conf, err := config.New("./etc/qmd.conf.sample")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 
 	Qmd := &qmd.Qmd{
@@ -55,11 +70,286 @@ func TestStartWaitJob(t *testing.T) {
 		t.Error("unexpected value")
 	}
 
-	// Test the cmd's STDOUT and STDERR.
-	if e := "stdoutstderr"; cmd.CmdOut.String() != e {
-		t.Errorf(`expected "%s", got "%s"`, e, cmd.CmdOut.String())
+	// Test the cmd's STDOUT and STDERR. The order of the streams
+	// in the combined output isn't guaranteed.
+	if e := "stdout"; cmd.Stdout.String() != e {
+		t.Errorf(`expected "%s", got "%s"`, e, cmd.Stdout.String())
+	}
+	if e := "stderr"; cmd.Stderr.String() != e {
+		t.Errorf(`expected "%s", got "%s"`, e, cmd.Stderr.String())
+	}
+	if out := cmd.CmdOut.String(); out != "stdoutstderr" && out != "stderrstdout" {
+		t.Errorf(`expected "stdoutstderr", got "%s"`, out)
 	}
 	if e := "result"; cmd.QmdOut.String() != e {
 		t.Errorf(`expected "%s", got "%s"`, e, cmd.CmdOut.String())
 	}
 }
+
+func TestKillJob(t *testing.T) {
+	conf, err := config.New("./etc/qmd.conf.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.WorkDir, err = ioutil.TempDir("", "qmd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(conf.WorkDir)
+	conf.KillGrace = 1
+
+	Qmd := &qmd.Qmd{Config: conf}
+
+	tt := []struct {
+		script string
+		signal string
+	}{
+		{"sleep 30", "SIGTERM"},
+		{"trap '' TERM; sleep 30", "SIGKILL"}, // Ignores SIGTERM.
+	}
+
+	for i, tc := range tt {
+		cmd := newTestCmd(t, Qmd, fmt.Sprintf("kill%d", i), tc.script)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		start := time.Now()
+		cmd.Kill()
+		cmd.Wait()
+		cmd.Cleanup()
+
+		if cmd.Signal != tc.signal {
+			t.Errorf("%v: expected %v, got %q", tc.script, tc.signal, cmd.Signal)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("%v: kill took %v", tc.script, time.Since(start))
+		}
+	}
+
+	// Subprocesses left behind, ignoring SIGTERM.
+	cmd := newTestCmd(t, Qmd, "leftover", "(trap '' TERM; exec sleep 30) >/dev/null 2>&1 &")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Cleanup()
+
+	pgid := cmd.Cmd.Process.Pid
+	for start := time.Now(); syscall.Kill(-pgid, 0) == nil; time.Sleep(100 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+			t.Fatal("subprocesses left after cleanup")
+		}
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	conf, err := config.New("./etc/qmd.conf.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.WorkDir, err = ioutil.TempDir("", "qmd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(conf.WorkDir)
+
+	Qmd := &qmd.Qmd{Config: conf}
+
+	// Open files limit.
+	cmd := newTestCmd(t, Qmd, "nofile", "ulimit -n")
+	cmd.Resources.OpenFiles = 64
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if e := "64\n"; cmd.CmdOut.String() != e {
+		t.Errorf("expected %q, got %q", e, cmd.CmdOut.String())
+	}
+
+	// CPU time limit.
+	cmd = newTestCmd(t, Qmd, "cpu", "while :; do :; done")
+	cmd.Resources.CPUTime = 1
+	cmd.Run()
+
+	if cmd.Signal != "SIGXCPU" {
+		t.Errorf("expected SIGXCPU, got %q", cmd.Signal)
+	}
+	if len(cmd.LimitsHit) != 1 || cmd.LimitsHit[0] != "cpu_time" {
+		t.Errorf("expected cpu_time limit hit, got %v", cmd.LimitsHit)
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running as another user requires root")
+	}
+
+	conf, err := config.New("./etc/qmd.conf.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.WorkDir, err = ioutil.TempDir("", "qmd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(conf.WorkDir)
+	if err := os.Chmod(conf.WorkDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	Qmd := &qmd.Qmd{Config: conf}
+
+	cmd := newTestCmd(t, Qmd, "runas", `id -u; id -g; echo ok >$QMD_TMP/file && echo ok >$QMD_OUT`)
+	cmd.Credential = &syscall.Credential{Uid: 65534, Gid: 65534, Groups: []uint32{}}
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if e := "65534\n65534\n"; cmd.CmdOut.String() != e {
+		t.Errorf("expected %q, got %q", e, cmd.CmdOut.String())
+	}
+	if e := "ok\n"; cmd.QmdOut.String() != e {
+		t.Errorf("expected %q, got %q", e, cmd.QmdOut.String())
+	}
+}
+
+func TestLineLog(t *testing.T) {
+	conf, err := config.New("./etc/qmd.conf.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.WorkDir, err = ioutil.TempDir("", "qmd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(conf.WorkDir)
+	conf.Output.LineLog = true
+
+	Qmd := &qmd.Qmd{Config: conf}
+
+	cmd := newTestCmd(t, Qmd, "lines", "echo one; echo two >&2; sleep 0.1; echo -n three")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := map[string][]string{}
+	for _, line := range cmd.Lines {
+		if line.Time.IsZero() {
+			t.Errorf("%q: missing time", line.Text)
+		}
+		lines[line.Stream] = append(lines[line.Stream], line.Text)
+	}
+	if e := "[one three]"; fmt.Sprint(lines["stdout"]) != e {
+		t.Errorf("expected stdout lines %v, got %v", e, lines["stdout"])
+	}
+	if e := "[two]"; fmt.Sprint(lines["stderr"]) != e {
+		t.Errorf("expected stderr lines %v, got %v", e, lines["stderr"])
+	}
+}
+
+func TestOutputLimits(t *testing.T) {
+	conf, err := config.New("./etc/qmd.conf.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.WorkDir, err = ioutil.TempDir("", "qmd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(conf.WorkDir)
+	conf.Output.Dir = conf.WorkDir + "/output"
+	conf.Output.MaxExecLog = 1
+	conf.Output.MaxOutput = 1
+
+	Qmd := &qmd.Qmd{Config: conf}
+
+	cmd := newTestCmd(t, Qmd, "limits", `echo head; for i in $(seq 1000); do echo "line $i"; done; echo tail; echo -n small >$QMD_OUT`)
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !cmd.Truncated() {
+		t.Error("expected truncated output")
+	}
+	if e := "small"; cmd.QmdOut.String() != e {
+		t.Errorf("expected %q, got %q", e, cmd.QmdOut.String())
+	}
+	out := cmd.CmdOut.String()
+	if len(out) > 1100 {
+		t.Errorf("expected about 1KB of exec_log, got %v bytes", len(out))
+	}
+	if !strings.HasPrefix(out, "head\n") || !strings.HasSuffix(out, "tail\n") || !strings.Contains(out, "bytes truncated") {
+		t.Errorf("expected head, tail and truncation marker, got %q", out)
+	}
+
+	// The whole output is spilled to disk.
+	full, err := ioutil.ReadFile(Qmd.Config.Output.Dir + "/limits/exec_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(full)) != cmd.CmdOut.Len() || !strings.Contains(string(full), "line 500\n") {
+		t.Errorf("expected %v bytes of exec_log, got %v", cmd.CmdOut.Len(), len(full))
+	}
+}
+
+func TestEnv(t *testing.T) {
+	conf, err := config.New("./etc/qmd.conf.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.WorkDir, err = ioutil.TempDir("", "qmd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(conf.WorkDir)
+	conf.Env.Clean = true
+
+	Qmd := &qmd.Qmd{Config: conf}
+
+	os.Setenv("QMD_TEST_SECRET", "secret")
+	defer os.Unsetenv("QMD_TEST_SECRET")
+
+	cmd := newTestCmd(t, Qmd, "env", `echo "$TARGET $HOME $QMD_TEST_SECRET"`)
+	cmd.Env = []string{"TARGET=staging"}
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if e := "staging " + Qmd.Config.WorkDir + "/env \n"; cmd.CmdOut.String() != e {
+		t.Errorf("expected %q, got %q", e, cmd.CmdOut.String())
+	}
+}
+
+func TestStagedFiles(t *testing.T) {
+	conf, err := config.New("./etc/qmd.conf.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.WorkDir, err = ioutil.TempDir("", "qmd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(conf.WorkDir)
+
+	Qmd := &qmd.Qmd{Config: conf}
+
+	staging := Qmd.Config.WorkDir + "/staging"
+	if err := os.Mkdir(staging, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(staging+"/data.txt", []byte("staged\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cmd's changes don't leak to the staged file.
+	cmd := newTestCmd(t, Qmd, "staged", "cat data.txt; echo changed >>data.txt")
+	cmd.StagingDir = staging
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if e := "staged\n"; cmd.CmdOut.String() != e {
+		t.Errorf("expected %q, got %q", e, cmd.CmdOut.String())
+	}
+	if data, _ := ioutil.ReadFile(staging + "/data.txt"); string(data) != "staged\n" {
+		t.Errorf("staged file changed to %q", data)
+	}
+}
@@ -11,26 +11,140 @@ var ErrNoConfFile = errors.New("no configuration file specified")
 
 // Config holds configuration read from config file.
 type Config struct {
-	Bind        string      `toml:"bind"`
-	URL         string      `toml:"url"`
-	ScriptDir   string      `toml:"script_dir"`
-	WorkDir     string      `toml:"work_dir"`
-	StoreDir    string      `toml:"store_dir"`
-	MaxJobs     int         `toml:"max_jobs"`
-	MaxExecTime int         `toml:"max_exec_time"`
-	DB          DBConfig    `toml:"db"`
-	Queue       QueueConfig `toml:"queue"`
-	Slack       SlackConfig `toml:"slack"`
+	Bind        string         `toml:"bind"`
+	URL         string         `toml:"url"`
+	ScriptDir   string         `toml:"script_dir"`
+	WorkDir     string         `toml:"work_dir"`
+	StoreDir    string         `toml:"store_dir"`
+	MaxJobs     int            `toml:"max_jobs"`
+	MaxExecTime int            `toml:"max_exec_time"`
+	MaxTimeout  int            `toml:"max_timeout"`       // Max timeout of scripts and requests. Default max_exec_time.
+	KillGrace   int            `toml:"kill_grace_period"` // Seconds between SIGTERM and SIGKILL of killed jobs. Default 10.
+	RunAsUser   string         `toml:"run_as_user"`       // User name or ID to run the jobs as. Default QMD's own user.
+	RunAsGroup  string         `toml:"run_as_group"`      // Group name or ID to run the jobs as. Default run_as_user's group.
+	DB          DBConfig       `toml:"db"`
+	Queue       QueueConfig    `toml:"queue"`
+	Callback    CallbackConfig `toml:"callback"`
+	Auth        AuthConfig     `toml:"auth"`
+	Limits      []LimitConfig  `toml:"limits"`
+	Resources   Resources      `toml:"resources"`  // Default resource limits of the jobs.
+	CgroupDir   string         `toml:"cgroup_dir"` // Writable cgroup v2 directory for the jobs' cgroups.
+	Sandbox     SandboxConfig  `toml:"sandbox"`
+	Output      OutputConfig   `toml:"output"`
+	Artifacts   ArtifactConfig `toml:"artifacts"`
+	Files       FilesConfig    `toml:"files"`
+	Env         EnvConfig      `toml:"env"`
+	Scripts     ScriptsConfig  `toml:"scripts"`
+	Slack       SlackConfig    `toml:"slack"`
 }
 
 type DBConfig struct {
+	Backend  string `toml:"backend"` // "redis" (default) or "file"
 	RedisURI string `toml:"redis_uri"`
+	Dir      string `toml:"dir"` // Directory of the "file" backend.
 }
 
 type QueueConfig struct {
+	Backend   string `toml:"backend"` // "disque" (default) or "memory"
 	DisqueURI string `toml:"disque_uri"`
 }
 
+// CallbackConfig controls delivery of the async responses to callback_url.
+// Zero values fall back to defaults.
+type CallbackConfig struct {
+	MaxAttempts int `toml:"max_attempts"` // Default 10.
+	Backoff     int `toml:"backoff"`      // Initial retry delay in seconds, doubled on each attempt. Default 1.
+	MaxBackoff  int `toml:"max_backoff"`  // Max retry delay in seconds. Default 3600.
+	Timeout     int `toml:"timeout"`      // HTTP request timeout in seconds. Default 30.
+
+	// Secret, if set, is used to sign the callbacks, see the signature package.
+	Secret string `toml:"secret"`
+}
+
+// AuthConfig controls bearer token authentication of the API.
+type AuthConfig struct {
+	Enabled bool          `toml:"enabled"`
+	Tokens  []TokenConfig `toml:"tokens"`
+}
+
+type TokenConfig struct {
+	Name    string   `toml:"name"`
+	Token   string   `toml:"token"`
+	Scripts []string `toml:"scripts"` // Glob patterns of the scripts the token can run.
+	Jobs    bool     `toml:"jobs"`    // Can read (and cancel) jobs.
+}
+
+// LimitConfig caps number of the concurrent jobs of the scripts
+// matching the glob pattern, on each QMD node, and their execution time.
+type LimitConfig struct {
+	Script  string `toml:"script"`
+	MaxJobs int    `toml:"max_jobs"`
+	Timeout int    `toml:"timeout"` // In seconds.
+
+	RunAsUser  string `toml:"run_as_user"`
+	RunAsGroup string `toml:"run_as_group"`
+
+	Env       map[string]string `toml:"env"` // Environment of the scripts' jobs.
+	Resources Resources         `toml:"resources"`
+}
+
+// Resources limits resources of a job. Zero values mean no limit.
+// The rlimits apply to each process of the job, the cgroup limits
+// (Memory and CPUs) to the job as a whole and need cgroup_dir.
+type Resources struct {
+	AddressSpace int     `toml:"address_space" json:"address_space,omitempty"` // RLIMIT_AS in MB.
+	CPUTime      int     `toml:"cpu_time" json:"cpu_time,omitempty"`           // RLIMIT_CPU in seconds.
+	OpenFiles    int     `toml:"open_files" json:"open_files,omitempty"`       // RLIMIT_NOFILE.
+	Processes    int     `toml:"processes" json:"processes,omitempty"`         // RLIMIT_NPROC, per user.
+	Memory       int     `toml:"memory" json:"memory,omitempty"`               // cgroup memory.max in MB.
+	CPUs         float64 `toml:"cpus" json:"cpus,omitempty"`                   // cgroup cpu.max quota in CPUs.
+}
+
+// OutputConfig controls capture of the jobs' output.
+type OutputConfig struct {
+	LineLog    bool   `toml:"line_log"`     // Store timestamped, stream-tagged lines of the output.
+	MaxExecLog int    `toml:"max_exec_log"` // Max size of exec_log, stdout and stderr in KB. Zero means no limit.
+	MaxOutput  int    `toml:"max_output"`   // Max size of output in KB. Zero means no limit.
+	Dir        string `toml:"dir"`          // Directory of the overflowing output. Default <store_dir>/qmd/output.
+}
+
+// EnvConfig controls environment of the jobs.
+type EnvConfig struct {
+	Clean bool              `toml:"clean"` // Start the jobs with minimal environment instead of QMD's.
+	Vars  map[string]string `toml:"vars"`  // Environment of all the jobs.
+}
+
+// FilesConfig limits the files sent with the requests.
+type FilesConfig struct {
+	MaxFileSize  int    `toml:"max_file_size"`  // In MB. Zero means no limit.
+	MaxTotalSize int    `toml:"max_total_size"` // In MB. Zero means no limit.
+	StagingDir   string `toml:"staging_dir"`    // Directory of the uploaded files. Default <store_dir>/qmd/staging.
+}
+
+// ArtifactConfig controls the store of the jobs' artifacts.
+type ArtifactConfig struct {
+	Backend string `toml:"backend"`  // "file" (default)
+	Dir     string `toml:"dir"`      // Directory of the "file" backend. Default <store_dir>/qmd/artifacts.
+	MaxSize int    `toml:"max_size"` // Max total size of the job's artifacts in MB. Zero means no limit.
+}
+
+// SandboxConfig controls the sandbox of the jobs. Sandboxed jobs run
+// as an unprivileged user, chrooted in new namespaces, with only
+// QMD_TMP, QMD_STORE, script_dir, the ReadOnly paths and a minimal
+// /dev visible.
+type SandboxConfig struct {
+	Enabled  bool     `toml:"enabled"`
+	UID      int      `toml:"uid"`       // Default 65534, unless run_as_user is set.
+	GID      int      `toml:"gid"`       // Default 65534, unless run_as_user is set.
+	Network  bool     `toml:"network"`   // Share the host's network.
+	ReadOnly []string `toml:"read_only"` // Host paths visible read-only. Default system dirs.
+}
+
+// ScriptsConfig controls the notifications of script_dir changes.
+type ScriptsConfig struct {
+	OnChangeURL string `toml:"on_change_url"` // URL to POST the added, removed and modified scripts to.
+}
+
 type SlackConfig struct {
 	Enabled    bool   `toml:"enabled"`
 	WebhookURL string `toml:"webhook_url"`
@@ -1,114 +1,83 @@
 package qmd
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
-	"github.com/garyburd/redigo/redis"
-
+	"github.com/pressly/qmd/config"
 	"github.com/pressly/qmd/rest/api"
 )
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound    = errors.New("not found")
+	ErrJobFinished = errors.New("job has finished already")
 )
 
 const logTTL = 7 * 24 * 60 * 60 // 1 week in seconds
 
-type DB struct {
-	pool *redis.Pool
-}
-
-func NewDB(address string) (*DB, error) {
-	pool := &redis.Pool{
-		MaxIdle:     1024,
-		MaxActive:   1024,
-		IdleTimeout: 300 * time.Second,
-		Wait:        true,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", address)
-			if err != nil {
-				return nil, err
-			}
-			return c, err
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
-	}
-	return &DB{pool: pool}, nil
-}
-
-func (db *DB) Close() {
-	db.pool.Close()
-}
-
-func (db *DB) Ping() error {
-	sess := db.conn()
-	defer sess.Close()
-	if _, err := sess.Do("PING"); err != nil {
-		return err
-	}
-	return nil
+// Store persists responses of the finished jobs.
+type Store interface {
+	// SaveResponse stores the response for logTTL seconds. It returns
+	// ErrJobFinished, if the job's response is stored already.
+	SaveResponse(resp *api.ScriptsResponse) error
+	// UpdateResponse overwrites the stored response.
+	UpdateResponse(resp *api.ScriptsResponse) error
+	// GetResponse returns JSON encoded response, or ErrNotFound.
+	GetResponse(ID string) ([]byte, error)
+	// Len returns number of the responses in the store.
+	Len() (int, error)
+	// TotalLen returns number of all the responses ever saved.
+	TotalLen() (int, error)
+	// ListResponses returns a page of the responses matching the query,
+	// newest first, with the response output stripped. The cursor of
+	// the next page is empty on the last page.
+	ListResponses(q *JobsQuery) (resps []*api.ScriptsResponse, next string, err error)
+	// FinishedLen returns number of all the responses of the given
+	// priority ever saved.
+	FinishedLen(priority string) (int, error)
+
+	// AppendLog appends chunk of output to the job's live log.
+	AppendLog(ID string, chunk []byte) error
+	// GetLog returns the job's live log starting at offset.
+	GetLog(ID string, offset int) ([]byte, error)
+	// DeleteLog removes the job's live log.
+	DeleteLog(ID string) error
+	// ExpireLog makes the job's live log expire in ttl seconds.
+	ExpireLog(ID string, ttl int) error
+
+	// CancelJob asks the job's worker, on whichever node it runs,
+	// to cancel the job.
+	CancelJob(ID string) error
+	// JobCancelled reports whether the job was asked to be cancelled.
+	JobCancelled(ID string) (bool, error)
+
+	// SaveCallback puts the callback into the outbox. It's due
+	// at cb.NextAttempt.
+	SaveCallback(cb *Callback) error
+	// ClaimCallbacks returns up to n callbacks that are due and
+	// postpones them by lease, so they're not claimed again meanwhile.
+	ClaimCallbacks(n int, lease time.Duration) ([]*Callback, error)
+	// DeleteCallback removes the callback from the outbox.
+	DeleteCallback(ID string) error
+	// DeadLetterCallback moves the callback from the outbox
+	// to the dead-letter list.
+	DeadLetterCallback(cb *Callback) error
+
+	// GetToken returns the API token by its TokenHash, or ErrNotFound.
+	GetToken(hash string) (*Token, error)
+
+	Ping() error
+	Close()
 }
 
-func (db *DB) SaveResponse(resp *api.ScriptsResponse) error {
-	sess := db.conn()
-	defer sess.Close()
-	data, err := json.Marshal(resp)
-	if err != nil {
-		return err
-	}
-
-	sess.Send("MULTI")
-	sess.Send("INCR", redis.Args{}.Add("qmd:finished")...)
-	sess.Send("SET", redis.Args{}.Add("qmd:job:"+resp.ID).Add(data)...)
-	sess.Send("EXPIRE", redis.Args{}.Add("qmd:job:"+resp.ID).Add(logTTL)...)
-	_, err = sess.Do("EXEC")
-	return err
-}
-
-func (db *DB) GetResponse(ID string) ([]byte, error) {
-	sess := db.conn()
-	defer sess.Close()
-
-	reply, err := redis.Bytes(sess.Do("GET", "qmd:job:"+ID))
-	if err != nil {
-		if err == redis.ErrNil {
-			return nil, ErrNotFound
-		}
-		return nil, err
+// NewStore creates Store backend specified in config.
+func NewStore(conf *config.Config) (Store, error) {
+	switch conf.DB.Backend {
+	case "", "redis":
+		return NewRedisStore(conf.DB.RedisURI)
+	case "file":
+		return NewFileStore(conf.DB.Dir)
 	}
-
-	return reply, nil
-}
-
-func (db *DB) TotalLen() (int, error) {
-	sess := db.conn()
-	defer sess.Close()
-
-	reply, err := redis.Int(sess.Do("GET", "qmd:finished"))
-	if err != nil {
-		return 0, err
-	}
-
-	return reply, nil
-}
-
-func (db *DB) Len() (int, error) {
-	sess := db.conn()
-	defer sess.Close()
-
-	reply, err := redis.Strings(sess.Do("KEYS", "qmd:job:*"))
-	if err != nil {
-		return 0, err
-	}
-
-	return len(reply), nil
-}
-
-func (db *DB) conn() redis.Conn {
-	return db.pool.Get()
+	return nil, fmt.Errorf("db: unknown backend \"%v\"", conf.DB.Backend)
 }
@@ -0,0 +1,515 @@
+package qmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pressly/qmd/rest/api"
+)
+
+// FileStore is a Store keeping the responses as JSON files in a local
+// directory. It's meant for single-node deployments that don't run Redis.
+//
+// Layout of the directory:
+//
+//	jobs/<ID>.json      - response of the job; expires logTTL after its mtime
+//	logs/<ID>.log       - live output of the job; expires logTTL after its mtime
+//	cancels/<ID>        - request to cancel the job; expires logTTL after its mtime
+//	callbacks/<ID>.json - callback in the outbox
+//	dead/<ID>.json      - callback in the dead-letter list
+//	tokens/<hash>.json  - API token, see TokenHash
+//	finished            - total number of the saved responses
+//	finished.<priority> - number of the saved responses of the priority
+type FileStore struct {
+	dir string
+	ttl time.Duration
+
+	mu sync.Mutex // guards the finished counter file and the outbox
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, errors.New("db: dir must be set for the file backend")
+	}
+	for _, subdir := range []string{"jobs", "logs", "cancels", "callbacks", "dead", "tokens"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &FileStore{
+		dir: dir,
+		ttl: time.Duration(logTTL) * time.Second,
+	}, nil
+}
+
+func (db *FileStore) Close() {}
+
+func (db *FileStore) Ping() error {
+	info, err := os.Stat(filepath.Join(db.dir, "jobs"))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("db: " + db.dir + "/jobs is not a directory")
+	}
+	return nil
+}
+
+func (db *FileStore) SaveResponse(resp *api.ScriptsResponse) error {
+	file, err := db.file("jobs", resp.ID, ".json")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	err = createFileAtomic(file, data)
+	if os.IsExist(err) {
+		// The expired responses are removed only when they're read.
+		if info, statErr := os.Stat(file); statErr == nil && db.expired(info) {
+			os.Remove(file)
+			err = createFileAtomic(file, data)
+		}
+	}
+	if os.IsExist(err) {
+		return ErrJobFinished
+	}
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.incrCounter("finished"); err != nil {
+		return err
+	}
+	if resp.Priority != "" {
+		return db.incrCounter("finished." + resp.Priority)
+	}
+	return nil
+}
+
+func (db *FileStore) UpdateResponse(resp *api.ScriptsResponse) error {
+	file, err := db.file("jobs", resp.ID, ".json")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(file, data)
+}
+
+func (db *FileStore) GetResponse(ID string) ([]byte, error) {
+	file, err := db.file("jobs", ID, ".json")
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if db.expired(info) {
+		os.Remove(file)
+		return nil, ErrNotFound
+	}
+
+	return ioutil.ReadFile(file)
+}
+
+// ListResponses reads all the responses, as there are no indexes
+// in the file store.
+func (db *FileStore) ListResponses(q *JobsQuery) ([]*api.ScriptsResponse, string, error) {
+	var cursorScore int64
+	var cursorID string
+	if q.Cursor != "" {
+		var err error
+		if cursorScore, cursorID, err = decodeCursor(q.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	infos, err := ioutil.ReadDir(filepath.Join(db.dir, "jobs"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var resps []*api.ScriptsResponse
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") || db.expired(info) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(db.dir, "jobs", info.Name()))
+		if err != nil {
+			continue
+		}
+		var resp api.ScriptsResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			continue
+		}
+		if !q.Match(&resp) {
+			continue
+		}
+		if q.Cursor != "" && !afterCursor(historyScore(&resp), resp.ID, cursorScore, cursorID) {
+			continue
+		}
+		resps = append(resps, summary(&resp))
+	}
+
+	sort.Sort(byHistory(resps))
+
+	var next string
+	if q.Limit > 0 && len(resps) > q.Limit {
+		resps = resps[:q.Limit]
+		last := resps[len(resps)-1]
+		next = encodeCursor(historyScore(last), last.ID)
+	}
+	return resps, next, nil
+}
+
+// byHistory sorts the responses newest first, see afterCursor.
+type byHistory []*api.ScriptsResponse
+
+func (s byHistory) Len() int      { return len(s) }
+func (s byHistory) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byHistory) Less(i, j int) bool {
+	return afterCursor(historyScore(s[j]), s[j].ID, historyScore(s[i]), s[i].ID)
+}
+
+func (db *FileStore) TotalLen() (int, error) {
+	return db.counter("finished")
+}
+
+func (db *FileStore) FinishedLen(priority string) (int, error) {
+	if strings.ContainsAny(priority, `/\`) {
+		return 0, nil
+	}
+	return db.counter("finished." + priority)
+}
+
+func (db *FileStore) counter(name string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(db.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// incrCounter must be called with db.mu held.
+func (db *FileStore) incrCounter(name string) error {
+	n, err := db.counter(name)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(db.dir, name), []byte(strconv.Itoa(n+1)))
+}
+
+func (db *FileStore) AppendLog(ID string, chunk []byte) error {
+	file, err := db.file("logs", ID, ".log")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(chunk)
+	return err
+}
+
+func (db *FileStore) GetLog(ID string, offset int) ([]byte, error) {
+	file, err := db.file("logs", ID, ".log")
+	if err != nil {
+		return nil, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(int64(offset), os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+func (db *FileStore) DeleteLog(ID string) error {
+	file, err := db.file("logs", ID, ".log")
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ExpireLog backdates the log's mtime, so it's removed by the sweep
+// in ttl seconds.
+func (db *FileStore) ExpireLog(ID string, ttl int) error {
+	file, err := db.file("logs", ID, ".log")
+	if err != nil {
+		return err
+	}
+	t := time.Now().Add(time.Duration(ttl)*time.Second - db.ttl)
+	if err := os.Chtimes(file, t, t); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (db *FileStore) CancelJob(ID string) error {
+	file, err := db.file("cancels", ID, "")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, nil, 0644)
+}
+
+func (db *FileStore) JobCancelled(ID string) (bool, error) {
+	file, err := db.file("cancels", ID, "")
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(file); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (db *FileStore) SaveCallback(cb *Callback) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.writeCallback("callbacks", cb)
+}
+
+func (db *FileStore) ClaimCallbacks(n int, lease time.Duration) ([]*Callback, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	infos, err := ioutil.ReadDir(filepath.Join(db.dir, "callbacks"))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	cbs := []*Callback{}
+	for _, info := range infos {
+		if len(cbs) >= n {
+			break
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(db.dir, "callbacks", info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var cb *Callback
+		if err := json.Unmarshal(data, &cb); err != nil {
+			return nil, err
+		}
+		if cb.NextAttempt.After(now) {
+			continue
+		}
+
+		claimed := *cb
+		claimed.NextAttempt = now.Add(lease)
+		if err := db.writeCallback("callbacks", &claimed); err != nil {
+			return nil, err
+		}
+		cbs = append(cbs, cb)
+	}
+
+	return cbs, nil
+}
+
+func (db *FileStore) DeleteCallback(ID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	file, err := db.file("callbacks", ID, ".json")
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (db *FileStore) DeadLetterCallback(cb *Callback) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	file, err := db.file("callbacks", cb.ID, ".json")
+	if err != nil {
+		return err
+	}
+	if err := db.writeCallback("dead", cb); err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeCallback writes the callback into subdir. Caller must hold db.mu.
+func (db *FileStore) writeCallback(subdir string, cb *Callback) error {
+	file, err := db.file(subdir, cb.ID, ".json")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cb)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(file, data)
+}
+
+func (db *FileStore) GetToken(hash string) (*Token, error) {
+	file, err := db.file("tokens", hash, ".json")
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	var t *Token
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Len returns number of the unexpired responses. It removes
+// the expired responses, logs and cancel requests along the way.
+func (db *FileStore) Len() (int, error) {
+	for _, subdir := range []string{"logs", "cancels"} {
+		if _, err := db.sweep(subdir); err != nil {
+			return 0, err
+		}
+	}
+	return db.sweep("jobs")
+}
+
+// sweep removes the expired files from subdir and returns
+// number of the files left.
+func (db *FileStore) sweep(subdir string) (int, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(db.dir, subdir))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if db.expired(info) {
+			os.Remove(filepath.Join(db.dir, subdir, info.Name()))
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (db *FileStore) expired(info os.FileInfo) bool {
+	return time.Since(info.ModTime()) > db.ttl
+}
+
+// file returns path to the job's file in subdir. It refuses
+// IDs that could escape the subdir.
+func (db *FileStore) file(subdir string, ID string, ext string) (string, error) {
+	if ID == "" || strings.ContainsAny(ID, `/\`) || strings.HasPrefix(ID, ".") {
+		return "", errors.New("db: invalid job ID \"" + ID + "\"")
+	}
+	return filepath.Join(db.dir, subdir, ID+ext), nil
+}
+
+// writeFileAtomic writes data to a temporary file first and renames it,
+// so the readers never see partially written file.
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := writeTempFile(file, data)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// createFileAtomic is like writeFileAtomic, but it fails with an error
+// satisfying os.IsExist, if the file exists.
+func createFileAtomic(file string, data []byte) error {
+	tmp, err := writeTempFile(file, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Link(tmp, file)
+}
+
+// writeTempFile writes the data to a temporary file next to the file.
+func writeTempFile(file string, data []byte) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
@@ -0,0 +1,496 @@
+package qmd
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/pressly/qmd/rest/api"
+)
+
+// RedisStore is a Store backed by Redis.
+type RedisStore struct {
+	pool *redis.Pool
+}
+
+func NewRedisStore(address string) (*RedisStore, error) {
+	pool := &redis.Pool{
+		MaxIdle:     1024,
+		MaxActive:   1024,
+		IdleTimeout: 300 * time.Second,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial("tcp", address)
+			if err != nil {
+				return nil, err
+			}
+			return c, err
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	return &RedisStore{pool: pool}, nil
+}
+
+func (db *RedisStore) Close() {
+	db.pool.Close()
+}
+
+func (db *RedisStore) Ping() error {
+	sess := db.conn()
+	defer sess.Close()
+	if _, err := sess.Do("PING"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (db *RedisStore) SaveResponse(resp *api.ScriptsResponse) error {
+	sess := db.conn()
+	defer sess.Close()
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	// Never overwrite the response, e.g. of a job cancelled
+	// on another node.
+	reply, err := sess.Do("SET", "qmd:job:"+resp.ID, data, "EX", logTTL, "NX")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrJobFinished
+	}
+
+	sess.Send("MULTI")
+	sess.Send("INCR", redis.Args{}.Add("qmd:finished")...)
+	if resp.Priority != "" {
+		sess.Send("INCR", redis.Args{}.Add("qmd:finished:"+resp.Priority)...)
+	}
+	for _, key := range historyKeys(resp) {
+		sess.Send("ZADD", redis.Args{}.Add(key).Add(historyScore(resp)).Add(resp.ID)...)
+		sess.Send("ZREMRANGEBYSCORE", redis.Args{}.Add(key).Add("-inf").Add(expiredScore())...)
+		sess.Send("EXPIRE", redis.Args{}.Add(key).Add(logTTL)...)
+	}
+	_, err = sess.Do("EXEC")
+	return err
+}
+
+// historyKeys returns keys of the job history indexes the response
+// belongs to. The indexes are sorted sets of job IDs scored by
+// historyScore.
+func historyKeys(resp *api.ScriptsResponse) []string {
+	return []string{
+		"qmd:jobs",
+		"qmd:jobs:script:" + resp.Script,
+		"qmd:jobs:status:" + resp.Status,
+	}
+}
+
+// IndexResponses adds the responses saved before the job history was
+// indexed (by older QMD) to the history indexes, so they're listed and
+// counted. The responses are scanned only once; the indexes are marked
+// as complete afterwards.
+func (db *RedisStore) IndexResponses() error {
+	sess := db.conn()
+	defer sess.Close()
+
+	indexed, err := redis.Bool(sess.Do("EXISTS", "qmd:jobs:indexed"))
+	if err != nil || indexed {
+		return err
+	}
+
+	cursor := 0
+	for {
+		reply, err := redis.Values(sess.Do("SCAN", cursor, "MATCH", "qmd:job:*", "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			values, err := redis.Values(sess.Do("MGET", redis.Args{}.AddFlat(keys)...))
+			if err != nil {
+				return err
+			}
+			for _, value := range values {
+				data, ok := value.([]byte)
+				if !ok {
+					// The response has expired.
+					continue
+				}
+				var resp api.ScriptsResponse
+				if err := json.Unmarshal(data, &resp); err != nil || resp.ID == "" || resp.EndTime.IsZero() {
+					continue
+				}
+				for _, key := range historyKeys(&resp) {
+					sess.Send("ZADD", redis.Args{}.Add(key).Add(historyScore(&resp)).Add(resp.ID)...)
+					sess.Send("EXPIRE", redis.Args{}.Add(key).Add(logTTL)...)
+				}
+			}
+			if _, err := sess.Do(""); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	_, err = sess.Do("SET", "qmd:jobs:indexed", 1)
+	return err
+}
+
+// expiredScore is history score of the responses that have expired.
+func expiredScore() int64 {
+	return time.Now().Add(-logTTL*time.Second).UnixNano() / int64(time.Millisecond)
+}
+
+func (db *RedisStore) ListResponses(q *JobsQuery) ([]*api.ScriptsResponse, string, error) {
+	sess := db.conn()
+	defer sess.Close()
+
+	// Scan the most selective index, filter the rest.
+	key := "qmd:jobs"
+	switch {
+	case q.Script != "":
+		key = "qmd:jobs:script:" + q.Script
+	case q.Status != "":
+		key = "qmd:jobs:status:" + q.Status
+	}
+	if _, err := sess.Do("ZREMRANGEBYSCORE", key, "-inf", expiredScore()); err != nil {
+		return nil, "", err
+	}
+
+	var (
+		min         interface{} = "-inf"
+		max         interface{} = "+inf"
+		cursorScore int64
+		cursorID    string
+	)
+	if q.Cursor != "" {
+		var err error
+		if cursorScore, cursorID, err = decodeCursor(q.Cursor); err != nil {
+			return nil, "", err
+		}
+		max = cursorScore
+	}
+	if !q.Until.IsZero() {
+		until := q.Until.UnixNano() / int64(time.Millisecond)
+		if q.Cursor == "" || until < cursorScore {
+			max = until
+		}
+	}
+	if !q.Since.IsZero() {
+		min = q.Since.UnixNano() / int64(time.Millisecond)
+	}
+
+	batch := q.Limit + 1
+	if batch < 100 {
+		batch = 100
+	}
+
+	var (
+		resps []*api.ScriptsResponse
+		stale []string
+	)
+	for offset := 0; q.Limit <= 0 || len(resps) <= q.Limit; offset += batch {
+		reply, err := redis.Strings(sess.Do("ZREVRANGEBYSCORE", key, max, min, "WITHSCORES", "LIMIT", offset, batch))
+		if err != nil {
+			return nil, "", err
+		}
+
+		var IDs []string
+		args := redis.Args{}
+		for i := 0; i+1 < len(reply); i += 2 {
+			score, err := strconv.ParseInt(reply[i+1], 10, 64)
+			if err != nil {
+				return nil, "", err
+			}
+			if q.Cursor != "" && !afterCursor(score, reply[i], cursorScore, cursorID) {
+				continue
+			}
+			IDs = append(IDs, reply[i])
+			args = args.Add("qmd:job:" + reply[i])
+		}
+
+		if len(IDs) > 0 {
+			values, err := redis.Values(sess.Do("MGET", args...))
+			if err != nil {
+				return nil, "", err
+			}
+			for i, value := range values {
+				data, ok := value.([]byte)
+				if !ok {
+					// The response has expired.
+					stale = append(stale, IDs[i])
+					continue
+				}
+				var resp api.ScriptsResponse
+				if err := json.Unmarshal(data, &resp); err != nil {
+					continue
+				}
+				if !q.Match(&resp) {
+					continue
+				}
+				resps = append(resps, summary(&resp))
+				if q.Limit > 0 && len(resps) > q.Limit {
+					break
+				}
+			}
+		}
+
+		if len(reply) < 2*batch {
+			break
+		}
+	}
+
+	if len(stale) > 0 {
+		sess.Do("ZREM", redis.Args{}.Add(key).AddFlat(stale)...)
+	}
+
+	var next string
+	if q.Limit > 0 && len(resps) > q.Limit {
+		resps = resps[:q.Limit]
+		last := resps[len(resps)-1]
+		next = encodeCursor(historyScore(last), last.ID)
+	}
+	return resps, next, nil
+}
+
+func (db *RedisStore) UpdateResponse(resp *api.ScriptsResponse) error {
+	sess := db.conn()
+	defer sess.Close()
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	sess.Send("MULTI")
+	sess.Send("SET", redis.Args{}.Add("qmd:job:"+resp.ID).Add(data)...)
+	sess.Send("EXPIRE", redis.Args{}.Add("qmd:job:"+resp.ID).Add(logTTL)...)
+	_, err = sess.Do("EXEC")
+	return err
+}
+
+func (db *RedisStore) GetResponse(ID string) ([]byte, error) {
+	sess := db.conn()
+	defer sess.Close()
+
+	reply, err := redis.Bytes(sess.Do("GET", "qmd:job:"+ID))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func (db *RedisStore) AppendLog(ID string, chunk []byte) error {
+	sess := db.conn()
+	defer sess.Close()
+
+	sess.Send("MULTI")
+	sess.Send("APPEND", redis.Args{}.Add("qmd:log:"+ID).Add(chunk)...)
+	sess.Send("EXPIRE", redis.Args{}.Add("qmd:log:"+ID).Add(logTTL)...)
+	_, err := sess.Do("EXEC")
+	return err
+}
+
+func (db *RedisStore) GetLog(ID string, offset int) ([]byte, error) {
+	sess := db.conn()
+	defer sess.Close()
+
+	reply, err := redis.Bytes(sess.Do("GETRANGE", "qmd:log:"+ID, offset, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func (db *RedisStore) DeleteLog(ID string) error {
+	sess := db.conn()
+	defer sess.Close()
+
+	_, err := sess.Do("DEL", "qmd:log:"+ID)
+	return err
+}
+
+func (db *RedisStore) ExpireLog(ID string, ttl int) error {
+	sess := db.conn()
+	defer sess.Close()
+
+	_, err := sess.Do("EXPIRE", "qmd:log:"+ID, ttl)
+	return err
+}
+
+func (db *RedisStore) CancelJob(ID string) error {
+	sess := db.conn()
+	defer sess.Close()
+
+	_, err := sess.Do("SET", "qmd:cancel:"+ID, 1, "EX", logTTL)
+	return err
+}
+
+func (db *RedisStore) JobCancelled(ID string) (bool, error) {
+	sess := db.conn()
+	defer sess.Close()
+
+	return redis.Bool(sess.Do("EXISTS", "qmd:cancel:"+ID))
+}
+
+func (db *RedisStore) SaveCallback(cb *Callback) error {
+	sess := db.conn()
+	defer sess.Close()
+	data, err := json.Marshal(cb)
+	if err != nil {
+		return err
+	}
+
+	sess.Send("MULTI")
+	sess.Send("SET", redis.Args{}.Add("qmd:callback:"+cb.ID).Add(data)...)
+	sess.Send("ZADD", redis.Args{}.Add("qmd:callbacks").Add(cb.NextAttempt.Unix()).Add(cb.ID)...)
+	_, err = sess.Do("EXEC")
+	return err
+}
+
+// claimCallbacks atomically picks the due callbacks and postpones them.
+var claimCallbacks = redis.NewScript(1, `
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[3])
+for _, id in ipairs(ids) do
+	redis.call("ZADD", KEYS[1], ARGV[2], id)
+end
+return ids
+`)
+
+func (db *RedisStore) ClaimCallbacks(n int, lease time.Duration) ([]*Callback, error) {
+	sess := db.conn()
+	defer sess.Close()
+
+	now := time.Now()
+	ids, err := redis.Strings(claimCallbacks.Do(sess, "qmd:callbacks", now.Unix(), now.Add(lease).Unix(), n))
+	if err != nil {
+		return nil, err
+	}
+
+	cbs := []*Callback{}
+	for _, id := range ids {
+		data, err := redis.Bytes(sess.Do("GET", "qmd:callback:"+id))
+		if err == redis.ErrNil {
+			sess.Do("ZREM", "qmd:callbacks", id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var cb *Callback
+		if err := json.Unmarshal(data, &cb); err != nil {
+			return nil, err
+		}
+		cbs = append(cbs, cb)
+	}
+
+	return cbs, nil
+}
+
+func (db *RedisStore) DeleteCallback(ID string) error {
+	sess := db.conn()
+	defer sess.Close()
+
+	sess.Send("MULTI")
+	sess.Send("ZREM", "qmd:callbacks", ID)
+	sess.Send("DEL", "qmd:callback:"+ID)
+	_, err := sess.Do("EXEC")
+	return err
+}
+
+func (db *RedisStore) DeadLetterCallback(cb *Callback) error {
+	sess := db.conn()
+	defer sess.Close()
+	data, err := json.Marshal(cb)
+	if err != nil {
+		return err
+	}
+
+	sess.Send("MULTI")
+	sess.Send("ZREM", "qmd:callbacks", cb.ID)
+	sess.Send("DEL", "qmd:callback:"+cb.ID)
+	sess.Send("RPUSH", redis.Args{}.Add("qmd:callbacks:dead").Add(data)...)
+	_, err = sess.Do("EXEC")
+	return err
+}
+
+func (db *RedisStore) GetToken(hash string) (*Token, error) {
+	sess := db.conn()
+	defer sess.Close()
+
+	reply, err := redis.Bytes(sess.Do("GET", "qmd:token:"+hash))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	var t *Token
+	if err := json.Unmarshal(reply, &t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (db *RedisStore) TotalLen() (int, error) {
+	sess := db.conn()
+	defer sess.Close()
+
+	reply, err := redis.Int(sess.Do("GET", "qmd:finished"))
+	if err != nil {
+		if err == redis.ErrNil {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return reply, nil
+}
+
+func (db *RedisStore) FinishedLen(priority string) (int, error) {
+	sess := db.conn()
+	defer sess.Close()
+
+	reply, err := redis.Int(sess.Do("GET", "qmd:finished:"+priority))
+	if err != nil {
+		if err == redis.ErrNil {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return reply, nil
+}
+
+func (db *RedisStore) Len() (int, error) {
+	sess := db.conn()
+	defer sess.Close()
+
+	if _, err := sess.Do("ZREMRANGEBYSCORE", "qmd:jobs", "-inf", expiredScore()); err != nil {
+		return 0, err
+	}
+	return redis.Int(sess.Do("ZCARD", "qmd:jobs"))
+}
+
+func (db *RedisStore) conn() redis.Conn {
+	return db.pool.Get()
+}
@@ -0,0 +1,93 @@
+package qmd
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// cleanEnv is the environment of the jobs started with clean environment,
+// in addition to HOME set to QMD_TMP.
+var cleanEnv = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+
+// cleanEnvPassed are QMD's variables passed to the jobs started
+// with clean environment.
+var cleanEnvPassed = []string{"LANG", "LC_ALL", "TZ"}
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validEnvName reports whether the variable can be set by the config
+// or by the request. Variables prefixed with QMD_ are reserved.
+func validEnvName(name string) bool {
+	return envNameRegexp.MatchString(name) && !strings.HasPrefix(name, "QMD_")
+}
+
+// environ returns the job's environment variables: the request's ones,
+// then the ones of the matching [[limits]], then the ones of [env.vars].
+func (qmd *Qmd) environ(script string, req map[string]string) []string {
+	sources := []map[string]string{req}
+	for _, limit := range qmd.Config.Limits {
+		if ok, _ := path.Match(limit.Script, script); ok {
+			sources = append(sources, limit.Env)
+		}
+	}
+	sources = append(sources, qmd.Config.Env.Vars)
+
+	vars := map[string]string{}
+	for _, s := range sources {
+		for name, value := range s {
+			if _, ok := vars[name]; !ok {
+				vars[name] = value
+			}
+		}
+	}
+
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// environ returns the cmd's environment: QMD's own, or the clean one,
+// overridden by cmd.Env and QMD's variables.
+func (cmd *Cmd) environ() []string {
+	var env []string
+	if cmd.CleanEnv {
+		env = append(env, cleanEnv...)
+		env = append(env, "HOME="+cmd.Cmd.Dir)
+		for _, name := range cleanEnvPassed {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	} else {
+		env = os.Environ()
+	}
+
+	env = mergeEnv(env, cmd.Env)
+	return mergeEnv(env, []string{
+		"QMD_TMP=" + cmd.Cmd.Dir,
+		"QMD_STORE=" + cmd.StoreDir,
+		"QMD_OUT=" + cmd.QmdOutFile,
+	})
+}
+
+// mergeEnv returns env with its variables overridden by the extra ones.
+func mergeEnv(env []string, extra []string) []string {
+	override := map[string]bool{}
+	for _, kv := range extra {
+		override[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+
+	merged := make([]string, 0, len(env)+len(extra))
+	for _, kv := range env {
+		if !override[strings.SplitN(kv, "=", 2)[0]] {
+			merged = append(merged, kv)
+		}
+	}
+	return append(merged, extra...)
+}
@@ -0,0 +1,7 @@
+#!/bin/bash
+
+DURATION=${1:-10}
+echo "Sleeping for $DURATION seconds."
+sleep $DURATION
+
+echo "Done."
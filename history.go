@@ -0,0 +1,85 @@
+package qmd
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pressly/qmd/rest/api"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// JobsQuery filters the job history. Zero values match all the jobs.
+type JobsQuery struct {
+	Script string
+	Status string
+	Since  time.Time // Jobs finished at or after Since.
+	Until  time.Time // Jobs finished at or before Until.
+	Limit  int
+
+	// Cursor returned by the previous page.
+	Cursor string
+}
+
+// Match reports whether the response satisfies the query filters.
+func (q *JobsQuery) Match(resp *api.ScriptsResponse) bool {
+	if q.Script != "" && resp.Script != q.Script {
+		return false
+	}
+	if q.Status != "" && resp.Status != q.Status {
+		return false
+	}
+	if !q.Since.IsZero() && resp.EndTime.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && resp.EndTime.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// The job history is ordered by end time (in milliseconds) and ID,
+// newest first. Cursor points to the last job of the page.
+
+func historyScore(resp *api.ScriptsResponse) int64 {
+	return resp.EndTime.UnixNano() / int64(time.Millisecond)
+}
+
+func encodeCursor(score int64, ID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(score, 10) + ":" + ID))
+}
+
+func decodeCursor(cursor string) (score int64, ID string, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", ErrInvalidCursor
+	}
+	score, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return score, parts[1], nil
+}
+
+// afterCursor reports whether the job comes after the cursor job.
+func afterCursor(score int64, ID string, cursorScore int64, cursorID string) bool {
+	return score < cursorScore || (score == cursorScore && ID < cursorID)
+}
+
+// summary strips the script's output from the response, so the job
+// history pages stay small.
+func summary(resp *api.ScriptsResponse) *api.ScriptsResponse {
+	resp.QmdOut = ""
+	resp.ExecLog = ""
+	resp.Stdout = ""
+	resp.Stderr = ""
+	resp.Lines = nil
+	return resp
+}
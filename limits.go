@@ -0,0 +1,108 @@
+package qmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/pressly/qmd/rest/api"
+)
+
+// Concurrency limits are enforced when the jobs are dequeued. Job of
+// a script at its limit is deferred by limitRetryDelay, so it stays
+// queued and the workers pick other work meanwhile. The limits are per
+// QMD node, like max_jobs.
+
+// limitRetryDelay is how long the job of a script at its limit waits
+// in the queue before it's dequeued again.
+const limitRetryDelay = time.Second
+
+// scriptLimit returns the concurrency limit of the script: max_jobs of
+// its manifest, or of the first [[limits]] config section matching it.
+// The limit is identified by the script name or by the glob pattern,
+// so all the scripts matching the pattern share the limit.
+func (qmd *Qmd) scriptLimit(script string) (key string, max int) {
+	if m, _ := qmd.Scripts.Manifest(script); m != nil && m.MaxJobs > 0 {
+		return script, m.MaxJobs
+	}
+	for _, limit := range qmd.Config.Limits {
+		if ok, _ := path.Match(limit.Script, script); ok && limit.MaxJobs > 0 {
+			return limit.Script, limit.MaxJobs
+		}
+	}
+	return "", 0
+}
+
+// Timeout returns execution timeout of the script's job. The requested
+// timeout (in seconds) takes precedence over the script's timeout:
+// timeout of its manifest, or of the first [[limits]] config section
+// matching it, or max_exec_time. Timeouts are capped by max_timeout;
+// it's an error to request more.
+func (qmd *Qmd) Timeout(script string, requested int) (time.Duration, error) {
+	max := qmd.Config.MaxTimeout
+	if max <= 0 {
+		max = qmd.Config.MaxExecTime
+	}
+	if requested < 0 {
+		return 0, errors.New("timeout must not be negative")
+	}
+	if requested > max {
+		return 0, fmt.Errorf("timeout %vs exceeds max_timeout %vs", requested, max)
+	}
+
+	timeout := requested
+	if timeout == 0 {
+		timeout = qmd.scriptTimeout(script)
+	}
+	if timeout > max {
+		timeout = max
+	}
+	return time.Duration(timeout) * time.Second, nil
+}
+
+func (qmd *Qmd) scriptTimeout(script string) int {
+	if m, _ := qmd.Scripts.Manifest(script); m != nil && m.Timeout > 0 {
+		return m.Timeout
+	}
+	for _, limit := range qmd.Config.Limits {
+		if ok, _ := path.Match(limit.Script, script); ok && limit.Timeout > 0 {
+			return limit.Timeout
+		}
+	}
+	return qmd.Config.MaxExecTime
+}
+
+// acquireLimit counts the job against the concurrency limit of its
+// script. It returns false, if the limit is reached. It's called before
+// the job is sent to a worker, which calls releaseLimit when done.
+func (qmd *Qmd) acquireLimit(job *Job) bool {
+	var req *api.ScriptsRequest
+	if err := json.Unmarshal([]byte(job.Data), &req); err != nil || req == nil {
+		// Let the worker fail the job.
+		return true
+	}
+	key, max := qmd.scriptLimit(req.Script)
+	if key == "" {
+		return true
+	}
+
+	qmd.muLimits.Lock()
+	defer qmd.muLimits.Unlock()
+
+	if qmd.limitRunning[key] >= max {
+		return false
+	}
+	qmd.limitRunning[key]++
+	job.limit = key
+	return true
+}
+
+func (qmd *Qmd) releaseLimit(job *Job) {
+	if job.limit != "" {
+		qmd.muLimits.Lock()
+		qmd.limitRunning[job.limit]--
+		qmd.muLimits.Unlock()
+	}
+}
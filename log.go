@@ -0,0 +1,164 @@
+package qmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/goware/lg"
+
+	"github.com/pressly/qmd/rest/api"
+)
+
+// logInterval is how often the live log is flushed to the store
+// and polled by its followers.
+const logInterval = 250 * time.Millisecond
+
+// finishedLogTTL is how long the live log is kept after the job has
+// finished, so its followers can catch up with the end of it. The full
+// output is in the job's response by then.
+const finishedLogTTL = 60 // 1 minute in seconds
+
+// LiveLog publishes the cmd's output to the store, so it can be followed
+// from any QMD node while the cmd is running. Writes are buffered and
+// flushed to the store every logInterval.
+type LiveLog struct {
+	db Store
+	ID string
+
+	// Max is the max size of the log; zero means no limit.
+	Max int
+
+	mu        sync.Mutex // guards the fields below
+	buf       bytes.Buffer
+	n         int
+	truncated bool
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func NewLiveLog(db Store, ID string) *LiveLog {
+	l := &LiveLog{
+		db:      db,
+		ID:      ID,
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go l.loop()
+	return l
+}
+
+func (l *LiveLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := len(p)
+	if l.Max > 0 && l.n+len(p) > l.Max {
+		if l.truncated {
+			return n, nil
+		}
+		l.truncated = true
+		p = append(p[:l.Max-l.n:l.Max-l.n], "\n[... truncated ...]\n"...)
+	}
+	l.n += len(p)
+	l.buf.Write(p)
+	return n, nil
+}
+
+// Close flushes the rest of the buffer to the store.
+func (l *LiveLog) Close() error {
+	close(l.closing)
+	<-l.closed
+	return nil
+}
+
+func (l *LiveLog) loop() {
+	defer close(l.closed)
+
+	ticker := time.NewTicker(logInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-l.closing:
+			l.flush()
+			return
+		}
+	}
+}
+
+func (l *LiveLog) flush() {
+	l.mu.Lock()
+	chunk := make([]byte, l.buf.Len())
+	copy(chunk, l.buf.Bytes())
+	l.buf.Reset()
+	l.mu.Unlock()
+
+	if len(chunk) == 0 {
+		return
+	}
+	if err := l.db.AppendLog(l.ID, chunk); err != nil {
+		lg.Errorf("Log:\tcan't append to log %v: %v", l.ID, err)
+	}
+}
+
+// FollowLog writes the job's output to w as it's being produced. It returns
+// when the job finishes or when stop is closed. Finished job's exec_log
+// is written right away.
+func (qmd *Qmd) FollowLog(ID string, w io.Writer, stop <-chan bool) error {
+	if data, err := qmd.DB.GetResponse(ID); err == nil {
+		return writeExecLog(w, data)
+	}
+
+	if _, err := qmd.Queue.Fetch(ID); err != nil {
+		// The job might have just finished.
+		data, err := qmd.DB.GetResponse(ID)
+		if err != nil {
+			return err
+		}
+		return writeExecLog(w, data)
+	}
+
+	offset := 0
+	for {
+		// Check before reading the log; the log is complete
+		// by the time the response is saved.
+		_, err := qmd.DB.GetResponse(ID)
+		finished := err == nil
+
+		chunk, err := qmd.DB.GetLog(ID, offset)
+		if err != nil {
+			return err
+		}
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			offset += len(chunk)
+		}
+
+		if finished {
+			return nil
+		}
+
+		select {
+		case <-time.After(logInterval):
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func writeExecLog(w io.Writer, data []byte) error {
+	var resp api.ScriptsResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, resp.ExecLog)
+	return err
+}
@@ -0,0 +1,224 @@
+package qmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/pressly/qmd/config"
+	"github.com/pressly/qmd/rest/api"
+)
+
+// ManifestExts lists the supported extensions of the script manifests.
+// Manifest of "build.sh" is a sidecar file "build.sh.toml" or "build.sh.json".
+var ManifestExts = []string{".toml", ".json"}
+
+// Manifest describes a script and restricts the requests to run it.
+type Manifest struct {
+	Description string `toml:"description" json:"description,omitempty"`
+
+	// Args are the allowed positional arguments. If set, no other
+	// arguments are allowed.
+	Args []*ManifestArg `toml:"args" json:"args,omitempty"`
+
+	// Env are the environment variables allowed in the request.
+	// If not set, no variables are allowed.
+	Env []*ManifestArg `toml:"env" json:"env,omitempty"`
+
+	// Files are the files required in the request.
+	Files []string `toml:"files" json:"files,omitempty"`
+
+	// Priority is the default priority of the script's jobs.
+	Priority string `toml:"priority" json:"priority,omitempty"`
+
+	// Timeout is the max execution time of the script in seconds,
+	// capped by max_timeout.
+	Timeout int `toml:"timeout" json:"timeout,omitempty"`
+
+	// MaxJobs is the max number of the script's concurrent jobs
+	// on each QMD node.
+	MaxJobs int `toml:"max_jobs" json:"max_jobs,omitempty"`
+
+	// Artifacts are glob patterns of the files in QMD_TMP to save
+	// as the job's artifacts, in addition to $QMD_TMP/artifacts/.
+	Artifacts []string `toml:"artifacts" json:"artifacts,omitempty"`
+
+	// RunAsUser and RunAsGroup are the user and group (names or IDs)
+	// to run the script as.
+	RunAsUser  string `toml:"run_as_user" json:"run_as_user,omitempty"`
+	RunAsGroup string `toml:"run_as_group" json:"run_as_group,omitempty"`
+
+	// Resources limits the script's processes.
+	Resources *config.Resources `toml:"resources" json:"resources,omitempty"`
+}
+
+type ManifestArg struct {
+	Name     string   `toml:"name" json:"name"`
+	Required bool     `toml:"required" json:"required,omitempty"`
+	Pattern  string   `toml:"pattern" json:"pattern,omitempty"` // The whole arg must match.
+	Values   []string `toml:"values" json:"values,omitempty"`   // Allowed values.
+
+	pattern *regexp.Regexp
+}
+
+// LoadManifest loads manifest of a given script, if there is one.
+// It returns nil manifest if there's no sidecar file.
+func LoadManifest(script string) (*Manifest, error) {
+	for _, ext := range ManifestExts {
+		file := script + ext
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// A null manifest is an empty one.
+		m := &Manifest{}
+		switch ext {
+		case ".toml":
+			_, err = toml.Decode(string(data), m)
+		case ".json":
+			err = json.Unmarshal(data, m)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", file, err)
+		}
+		if err := m.compile(); err != nil {
+			return nil, fmt.Errorf("%v: %v", file, err)
+		}
+		return m, nil
+	}
+	return nil, nil
+}
+
+func (m *Manifest) compile() error {
+	switch m.Priority {
+	case "", "low", "high", "urgent":
+	default:
+		return fmt.Errorf("unknown priority \"%v\"", m.Priority)
+	}
+	if m.MaxJobs < 0 {
+		return fmt.Errorf("max_jobs must not be negative")
+	}
+	if r := m.Resources; r != nil && (r.AddressSpace < 0 || r.CPUTime < 0 || r.OpenFiles < 0 || r.Processes < 0 || r.Memory < 0 || r.CPUs < 0) {
+		return fmt.Errorf("resources must not be negative")
+	}
+	for _, pattern := range m.Artifacts {
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" || filepath.IsAbs(pattern) || strings.Contains(pattern, "..") {
+			return fmt.Errorf("invalid artifacts pattern \"%v\"", pattern)
+		}
+	}
+	if _, err := lookupCredential(m.RunAsUser, m.RunAsGroup); err != nil {
+		return err
+	}
+
+	for i, arg := range m.Args {
+		if arg.Name == "" {
+			arg.Name = fmt.Sprintf("#%v", i+1)
+		}
+		if arg.Pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(`^(?:` + arg.Pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("arg %v: %v", arg.Name, err)
+		}
+		arg.pattern = re
+	}
+
+	for _, env := range m.Env {
+		if !validEnvName(env.Name) {
+			return fmt.Errorf("env: invalid name \"%v\"", env.Name)
+		}
+		if env.Pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(`^(?:` + env.Pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("env %v: %v", env.Name, err)
+		}
+		env.pattern = re
+	}
+	return nil
+}
+
+// Validate checks the request against the manifest.
+func (m *Manifest) Validate(req *api.ScriptsRequest) error {
+	if len(m.Args) > 0 && len(req.Args) > len(m.Args) {
+		return fmt.Errorf("too many args: %v given, %v allowed", len(req.Args), len(m.Args))
+	}
+
+	for i, arg := range m.Args {
+		if i >= len(req.Args) {
+			if arg.Required {
+				return fmt.Errorf("arg %v is required", arg.Name)
+			}
+			continue
+		}
+		if err := arg.validate("arg", req.Args[i]); err != nil {
+			return err
+		}
+	}
+
+	for name := range req.Env {
+		if m.env(name) == nil {
+			return fmt.Errorf("env %v is not allowed", name)
+		}
+	}
+	for _, env := range m.Env {
+		value, ok := req.Env[env.Name]
+		if !ok {
+			if env.Required {
+				return fmt.Errorf("env %v is required", env.Name)
+			}
+			continue
+		}
+		if err := env.validate("env", value); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range m.Files {
+		if _, ok := req.Files[file]; !ok && !contains(req.Uploads, file) {
+			return fmt.Errorf("file %v is required", file)
+		}
+	}
+
+	return nil
+}
+
+func (arg *ManifestArg) validate(kind string, value string) error {
+	if arg.pattern != nil && !arg.pattern.MatchString(value) {
+		return fmt.Errorf("%v %v: \"%v\" doesn't match \"%v\"", kind, arg.Name, value, arg.Pattern)
+	}
+	if len(arg.Values) > 0 && !contains(arg.Values, value) {
+		return fmt.Errorf("%v %v: \"%v\" is not one of %q", kind, arg.Name, value, arg.Values)
+	}
+	return nil
+}
+
+func (m *Manifest) env(name string) *ManifestArg {
+	for _, env := range m.Env {
+		if env.Name == name {
+			return env
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package qmd_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pressly/qmd"
+	"github.com/pressly/qmd/rest/api"
+)
+
+func TestManifestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qmd-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := `{
+		"args": [
+			{"name": "env", "required": true, "values": ["staging", "production"]},
+			{"name": "version", "pattern": "v[0-9]+"}
+		],
+		"files": ["config.json"]
+	}`
+	if err := ioutil.WriteFile(dir+"/deploy.sh.json", []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := qmd.LoadManifest(dir + "/deploy.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil {
+		t.Fatal("unexpected nil")
+	}
+
+	files := map[string]string{"config.json": "{}"}
+	tt := []struct {
+		req   api.ScriptsRequest
+		valid bool
+	}{
+		{api.ScriptsRequest{Args: []string{"staging"}, Files: files}, true},
+		{api.ScriptsRequest{Args: []string{"production", "v12"}, Files: files}, true},
+		{api.ScriptsRequest{Args: []string{}, Files: files}, false},
+		{api.ScriptsRequest{Args: []string{"dev"}, Files: files}, false},
+		{api.ScriptsRequest{Args: []string{"staging", "v12; rm -rf /"}, Files: files}, false},
+		{api.ScriptsRequest{Args: []string{"staging", "v1", "extra"}, Files: files}, false},
+		{api.ScriptsRequest{Args: []string{"staging"}}, false},
+	}
+	for _, tc := range tt {
+		err := m.Validate(&tc.req)
+		if tc.valid && err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.req.Args, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%v: expected error", tc.req.Args)
+		}
+	}
+
+	// Unknown user.
+	if err := ioutil.WriteFile(dir+"/user.sh.toml", []byte(`run_as_user = "qmd-no-such-user"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := qmd.LoadManifest(dir + "/user.sh"); err == nil {
+		t.Error("expected error for unknown run_as_user")
+	}
+
+	// Null manifest.
+	if err := ioutil.WriteFile(dir+"/null.sh.json", []byte("null"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err = qmd.LoadManifest(dir + "/null.sh")
+	if err != nil {
+		t.Error(err)
+	}
+	if m == nil {
+		t.Error("expected empty manifest")
+	}
+
+	// No manifest.
+	m, err = qmd.LoadManifest(dir + "/other.sh")
+	if err != nil {
+		t.Error(err)
+	}
+	if m != nil {
+		t.Error("expected nil")
+	}
+}
+
+func TestManifestEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qmd-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := `
+[[env]]
+name     = "TARGET"
+required = true
+values   = ["staging", "production"]
+
+[[env]]
+name     = "VERBOSE"
+pattern  = "[01]"
+`
+	if err := ioutil.WriteFile(dir+"/deploy.sh.toml", []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := qmd.LoadManifest(dir + "/deploy.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		env   map[string]string
+		valid bool
+	}{
+		{map[string]string{"TARGET": "staging"}, true},
+		{map[string]string{"TARGET": "production", "VERBOSE": "1"}, true},
+		{map[string]string{}, false},
+		{map[string]string{"TARGET": "dev"}, false},
+		{map[string]string{"TARGET": "staging", "VERBOSE": "yes"}, false},
+		{map[string]string{"TARGET": "staging", "PATH": "/tmp"}, false},
+	}
+	for _, tc := range tt {
+		err := m.Validate(&api.ScriptsRequest{Env: tc.env})
+		if tc.valid && err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.env, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%v: expected error", tc.env)
+		}
+	}
+
+	// Reserved name.
+	if err := ioutil.WriteFile(dir+"/qmd.sh.toml", []byte("[[env]]\nname = \"QMD_TMP\""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := qmd.LoadManifest(dir + "/qmd.sh"); err == nil {
+		t.Error("expected error for reserved env name")
+	}
+}
@@ -0,0 +1,201 @@
+package qmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// durationBuckets are the upper bounds (in seconds) of the job duration
+// histogram buckets.
+var durationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// Metrics collects QMD metrics for Prometheus. All the methods are safe
+// to call on nil *Metrics.
+type Metrics struct {
+	mu            sync.Mutex
+	jobs          map[[2]string]uint64  // Map of [script, status] to count.
+	durations     map[string]*histogram // Map of scripts to job durations.
+	callbacks     map[string]uint64     // Map of delivery outcomes to count.
+	slackFailures uint64
+}
+
+type histogram struct {
+	buckets []uint64 // Cumulated at exposition time.
+	count   uint64
+	sum     float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		jobs:      map[[2]string]uint64{},
+		durations: map[string]*histogram{},
+		callbacks: map[string]uint64{},
+	}
+}
+
+// JobFinished records the job's exit status, one of "ok", "err", "timeout",
+// "cancelled", "invalidated" or "failed_to_start", and its duration.
+func (m *Metrics) JobFinished(script string, status string, seconds float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jobs[[2]string{script, status}]++
+
+	h, ok := m.durations[script]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		m.durations[script] = h
+	}
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// CallbackAttempted records outcome of a callback delivery attempt,
+// one of "delivered", "retried" or "failed".
+func (m *Metrics) CallbackAttempted(outcome string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.callbacks[outcome]++
+}
+
+func (m *Metrics) SlackFailed(err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.slackFailures++
+}
+
+// FinishedJobs returns number of finished jobs per script.
+func (m *Metrics) FinishedJobs() map[string]int {
+	finished := map[string]int{}
+	if m == nil {
+		return finished
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, n := range m.jobs {
+		finished[key[0]] += int(n)
+	}
+	return finished
+}
+
+// WriteMetrics writes the metrics in Prometheus text exposition format.
+func (qmd *Qmd) WriteMetrics(w io.Writer) error {
+	b := bufio.NewWriter(w)
+
+	metric(b, "qmd_queue_jobs", "gauge", "Number of jobs in the queue.")
+	for _, priority := range Priorities {
+		queued, _ := qmd.Queue.Len(priority)
+		active, _ := qmd.Queue.ActiveLen(priority)
+		sample(b, "qmd_queue_jobs", labels("priority", priority, "state", "queued"), float64(queued))
+		sample(b, "qmd_queue_jobs", labels("priority", priority, "state", "active"), float64(active))
+	}
+
+	busy := qmd.BusyWorkers()
+	metric(b, "qmd_workers", "gauge", "Number of workers of this node.")
+	sample(b, "qmd_workers", labels("state", "busy"), float64(busy))
+	sample(b, "qmd_workers", labels("state", "idle"), float64(qmd.Config.MaxJobs-busy))
+
+	if m := qmd.Metrics; m != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		metric(b, "qmd_jobs_total", "counter", "Number of jobs run by this node, by exit status.")
+		keys := make([][2]string, 0, len(m.jobs))
+		for key := range m.jobs {
+			keys = append(keys, key)
+		}
+		sort.Sort(byLabels(keys))
+		for _, key := range keys {
+			sample(b, "qmd_jobs_total", labels("script", key[0], "status", key[1]), float64(m.jobs[key]))
+		}
+
+		metric(b, "qmd_job_duration_seconds", "histogram", "Duration of jobs run by this node.")
+		for _, script := range sortedKeys(m.durations) {
+			h := m.durations[script]
+			cumulative := uint64(0)
+			for i, le := range durationBuckets {
+				cumulative += h.buckets[i]
+				sample(b, "qmd_job_duration_seconds_bucket", labels("script", script, "le", formatFloat(le)), float64(cumulative))
+			}
+			sample(b, "qmd_job_duration_seconds_bucket", labels("script", script, "le", "+Inf"), float64(h.count))
+			sample(b, "qmd_job_duration_seconds_sum", labels("script", script), h.sum)
+			sample(b, "qmd_job_duration_seconds_count", labels("script", script), float64(h.count))
+		}
+
+		metric(b, "qmd_callbacks_total", "counter", "Number of callback delivery attempts of this node, by outcome.")
+		for _, outcome := range []string{"delivered", "retried", "failed"} {
+			sample(b, "qmd_callbacks_total", labels("outcome", outcome), float64(m.callbacks[outcome]))
+		}
+
+		metric(b, "qmd_slack_notify_failures_total", "counter", "Number of failed Slack notifications.")
+		sample(b, "qmd_slack_notify_failures_total", "", float64(m.slackFailures))
+	}
+
+	return b.Flush()
+}
+
+func metric(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(w io.Writer, name string, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+// labels formats name/value pairs as {name="value",...}.
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type byLabels [][2]string
+
+func (s byLabels) Len() int      { return len(s) }
+func (s byLabels) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLabels) Less(i, j int) bool {
+	if s[i][0] != s[j][0] {
+		return s[i][0] < s[j][0]
+	}
+	return s[i][1] < s[j][1]
+}
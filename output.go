@@ -0,0 +1,241 @@
+package qmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/goware/lg"
+
+	"github.com/pressly/qmd/rest/api"
+)
+
+// streamWriter captures one of the cmd's streams, "stdout" or "stderr".
+// It writes the stream to its own buffer, to the combined output and,
+// if enabled, to the cmd's line log.
+type streamWriter struct {
+	cmd      *Cmd
+	name     string
+	buf      *OutputBuffer
+	combined io.Writer
+	partial  []byte // Unterminated line of the line log.
+}
+
+func (cmd *Cmd) newStreamWriter(name string, buf *OutputBuffer, combined io.Writer) *streamWriter {
+	w := &streamWriter{
+		cmd:      cmd,
+		name:     name,
+		buf:      buf,
+		combined: combined,
+	}
+	cmd.streams = append(cmd.streams, w)
+	return w
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	// Both streams write to the combined output.
+	w.cmd.muOut.Lock()
+	defer w.cmd.muOut.Unlock()
+
+	n := len(p)
+	w.buf.Write(p)
+	w.combined.Write(p)
+
+	if !w.cmd.LineLog {
+		return n, nil
+	}
+	now := time.Now()
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, p...)
+			break
+		}
+		w.addLine(now, append(w.partial, p[:i]...))
+		w.partial = nil
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (w *streamWriter) addLine(t time.Time, line []byte) {
+	// The line log is capped by the exec_log limit.
+	if max := w.cmd.CmdOut.Max; max > 0 && w.cmd.linesSize+len(line) > max {
+		w.cmd.linesTruncated = true
+		return
+	}
+	w.cmd.linesSize += len(line)
+	w.cmd.Lines = append(w.cmd.Lines, api.LogLine{
+		Time:   t,
+		Stream: w.name,
+		Text:   string(line),
+	})
+}
+
+// flushStreams adds the unterminated lines to the line log,
+// once the cmd has finished.
+func (cmd *Cmd) flushStreams() {
+	cmd.muOut.Lock()
+	defer cmd.muOut.Unlock()
+
+	for _, w := range cmd.streams {
+		if len(w.partial) > 0 {
+			w.addLine(time.Now(), w.partial)
+			w.partial = nil
+		}
+	}
+}
+
+// OutputBuffer collects output of the cmd. If Max is set, it keeps only
+// the head and the tail of the output, Max bytes in total, and spills the
+// whole output to File once it overflows. Write never fails, so the cmd
+// doesn't get a broken pipe.
+type OutputBuffer struct {
+	Max  int
+	File string
+
+	buf   []byte // Whole output, or its tail once truncated.
+	head  []byte // Head of the truncated output.
+	total int64
+	f     *os.File
+	err   error // Spill error.
+}
+
+func (b *OutputBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if b.Max <= 0 || (b.head == nil && len(b.buf)+len(p) <= b.Max) {
+		b.buf = append(b.buf, p...)
+		return len(p), nil
+	}
+
+	if b.head == nil {
+		b.spill()
+	}
+	if b.f != nil {
+		if _, err := b.f.Write(p); err != nil {
+			b.fail(err)
+		}
+	}
+	b.buf = append(b.buf, p...)
+	if b.head == nil {
+		b.head = append([]byte{}, b.buf[:b.Max/2]...)
+		b.buf = append([]byte{}, b.buf[b.Max/2:]...)
+	}
+
+	// Keep the tail, trimmed once in a while.
+	if tail := b.Max - len(b.head); len(b.buf) > 2*tail {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-tail:]...)
+	}
+	return len(p), nil
+}
+
+// spill saves the output written so far to File.
+func (b *OutputBuffer) spill() {
+	if b.File == "" {
+		b.err = fmt.Errorf("no file to save it to")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(b.File), 0755); err != nil {
+		b.fail(err)
+		return
+	}
+	f, err := os.Create(b.File)
+	if err != nil {
+		b.fail(err)
+		return
+	}
+	b.f = f
+	if _, err := b.f.Write(b.buf); err != nil {
+		b.fail(err)
+	}
+}
+
+func (b *OutputBuffer) fail(err error) {
+	lg.Errorf("Cmd:\tcan't save output to %v: %v", b.File, err)
+	b.err = err
+	if b.f != nil {
+		b.f.Close()
+		b.f = nil
+	}
+}
+
+// Close closes the spill file, if any.
+func (b *OutputBuffer) Close() error {
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Close()
+	b.f = nil
+	return err
+}
+
+// Truncated reports whether the output has overflowed Max.
+func (b *OutputBuffer) Truncated() bool {
+	return b.head != nil
+}
+
+// Len returns length of the whole output.
+func (b *OutputBuffer) Len() int64 {
+	return b.total
+}
+
+// String returns the output, or its head and tail with a truncation
+// marker in between, if the output has overflowed.
+func (b *OutputBuffer) String() string {
+	if b.head == nil {
+		return string(b.buf)
+	}
+	tail := b.buf
+	if n := b.Max - len(b.head); len(tail) > n {
+		tail = tail[len(tail)-n:]
+	}
+	marker := fmt.Sprintf("\n[... %d bytes truncated ...]\n", b.total-int64(len(b.head)+len(tail)))
+	if b.err != nil {
+		marker = fmt.Sprintf("\n[... %d bytes truncated, full output not saved: %v ...]\n", b.total-int64(len(b.head)+len(tail)), b.err)
+	}
+	return string(b.head) + marker + string(tail)
+}
+
+// Truncated reports whether any of the cmd's output was truncated.
+func (cmd *Cmd) Truncated() bool {
+	return cmd.CmdOut.Truncated() || cmd.Stdout.Truncated() || cmd.Stderr.Truncated() || cmd.QmdOut.Truncated() || cmd.linesTruncated
+}
+
+// sweepInterval is how often the expired files of the jobs are removed.
+const sweepInterval = time.Hour
+
+// SweepJobFiles removes the spilled output and the artifacts of the jobs,
+// once their responses have expired, and the staged files of the jobs
+// that never ran.
+func (qmd *Qmd) SweepJobFiles() {
+	dir := qmd.outputDir()
+	for {
+		infos, _ := ioutil.ReadDir(dir)
+		for _, info := range infos {
+			if time.Since(info.ModTime()) > time.Duration(logTTL)*time.Second {
+				if err := os.RemoveAll(filepath.Join(dir, info.Name())); err != nil {
+					lg.Errorf("Output:\tcan't remove %v: %v", info.Name(), err)
+				}
+			}
+		}
+		qmd.sweepStaging()
+		if qmd.Artifacts != nil {
+			if err := qmd.Artifacts.Sweep(); err != nil {
+				lg.Errorf("Artifacts:\tcan't remove expired artifacts: %v", err)
+			}
+		}
+		time.Sleep(sweepInterval)
+	}
+}
+
+// outputDir returns directory of the spilled output.
+func (qmd *Qmd) outputDir() string {
+	if qmd.Config.Output.Dir != "" || qmd.Config.StoreDir == "" {
+		return qmd.Config.Output.Dir
+	}
+	return filepath.Join(privateDir(qmd.Config.StoreDir), "output")
+}
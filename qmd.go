@@ -1,34 +1,82 @@
 package qmd
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/goware/disque"
 	"github.com/goware/lg"
 
 	"github.com/pressly/qmd/config"
+	"github.com/pressly/qmd/signature"
 )
 
+// defaultSandboxID is uid and gid of the sandboxed jobs,
+// unless configured; "nobody" on most systems.
+const defaultSandboxID = 65534
+
+// defaultSandboxPaths are the host paths visible read-only
+// to the sandboxed jobs, unless configured.
+var defaultSandboxPaths = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/etc"}
+
+// privateDir returns QMD's own directory in the store dir, holding the
+// default output, staging and artifacts dirs. It's not visible to the
+// sandboxed jobs, even though they can write to the store dir.
+func privateDir(storeDir string) string {
+	if storeDir == "" {
+		return ""
+	}
+	return filepath.Join(storeDir, "qmd")
+}
+
 type Qmd struct {
 	Config  *config.Config
-	DB      *DB
-	Queue   *disque.Pool
+	DB      Store
+	Queue   Queue
 	Scripts Scripts
 	Workers chan Worker
 	Slack   *SlackNotifier
+	Metrics *Metrics
+
+	Artifacts ArtifactStore
+
+	muRunning   sync.Mutex      // guards running
+	running     map[string]*Cmd // Map of job IDs to cmds run by our workers.
+	busyWorkers int32           // Number of workers running a job; atomic.
+
+	muLimits     sync.Mutex     // guards limitRunning
+	limitRunning map[string]int // Map of limits to number of their running jobs.
+
+	cgroupDir    string  // cgroup_dir, if cgroups are available.
+	sandboxFlags uintptr // Namespaces of the sandboxed jobs.
 
 	Closing            bool
 	ClosingListenQueue chan struct{}
 	WaitListenQueue    sync.WaitGroup
 	ClosingWorkers     chan struct{}
 	WaitWorkers        sync.WaitGroup
+	ClosingCallbacks   chan struct{}
+	WaitCallbacks      sync.WaitGroup
 }
 
 func New(conf *config.Config) (*Qmd, error) {
-	db, err := NewDB(conf.DB.RedisURI)
+	if dir := privateDir(conf.StoreDir); dir != "" {
+		// Keep the jobs running as another user out.
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := NewStore(conf)
 	if err != nil {
 		return nil, err
 	}
@@ -37,24 +85,77 @@ func New(conf *config.Config) (*Qmd, error) {
 		return nil, err
 	}
 
-	queue, err := disque.New(conf.Queue.DisqueURI)
+	if db, ok := db.(*RedisStore); ok {
+		if err := db.IndexResponses(); err != nil {
+			return nil, fmt.Errorf("db: can't index job history: %v", err)
+		}
+	}
+
+	for _, limit := range conf.Limits {
+		if _, err := path.Match(limit.Script, ""); err != nil || limit.Script == "" {
+			return nil, fmt.Errorf("limits: invalid script pattern \"%v\"", limit.Script)
+		}
+	}
+
+	for name := range conf.Env.Vars {
+		if !validEnvName(name) {
+			return nil, fmt.Errorf("env: invalid name \"%v\"", name)
+		}
+	}
+	for _, limit := range conf.Limits {
+		for name := range limit.Env {
+			if !validEnvName(name) {
+				return nil, fmt.Errorf("limits: \"%v\": env: invalid name \"%v\"", limit.Script, name)
+			}
+		}
+	}
+
+	if _, err := lookupCredential(conf.RunAsUser, conf.RunAsGroup); err != nil {
+		return nil, err
+	}
+	for _, limit := range conf.Limits {
+		if _, err := lookupCredential(limit.RunAsUser, limit.RunAsGroup); err != nil {
+			return nil, fmt.Errorf("limits: \"%v\": %v", limit.Script, err)
+		}
+	}
+
+	var sandboxFlags uintptr
+	if conf.Sandbox.Enabled {
+		if conf.Sandbox.UID == 0 {
+			conf.Sandbox.UID = defaultSandboxID
+		}
+		if conf.Sandbox.GID == 0 {
+			conf.Sandbox.GID = defaultSandboxID
+		}
+		if conf.Sandbox.ReadOnly == nil {
+			conf.Sandbox.ReadOnly = defaultSandboxPaths
+		}
+		if sandboxFlags, err = probeSandbox(&conf.Sandbox); err != nil {
+			return nil, err
+		}
+	}
+
+	artifacts, err := NewArtifactStore(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := NewQueue(conf)
 	if err != nil {
 		return nil, err
 	}
-	queue.Use(disque.Config{
-		RetryAfter: time.Duration(conf.MaxExecTime) * time.Second,
-		Timeout:    time.Second,
-	})
 
 	if err := queue.Ping(); err != nil {
 		return nil, err
 	}
 
-	// TODO: SlackNOP.
+	metrics := NewMetrics()
+
 	slack := &SlackNotifier{
 		WebhookURL: conf.Slack.WebhookURL,
 		Channel:    conf.Slack.Channel,
 		Prefix:     fmt.Sprintf("%v: ", conf.URL),
+		OnError:    metrics.SlackFailed,
 	}
 
 	qmd := &Qmd{
@@ -62,9 +163,19 @@ func New(conf *config.Config) (*Qmd, error) {
 		DB:                 db,
 		Queue:              queue,
 		Workers:            make(chan Worker, conf.MaxJobs),
+		running:            map[string]*Cmd{},
+		limitRunning:       map[string]int{},
 		ClosingListenQueue: make(chan struct{}),
 		ClosingWorkers:     make(chan struct{}),
+		ClosingCallbacks:   make(chan struct{}),
 		Slack:              slack,
+		Metrics:            metrics,
+		Artifacts:          artifacts,
+		cgroupDir:          initCgroups(conf.CgroupDir),
+		sandboxFlags:       sandboxFlags,
+	}
+	if conf.Scripts.OnChangeURL != "" {
+		qmd.Scripts.OnChange = qmd.notifyScriptsChange
 	}
 
 	if err := lg.SetLevelString("debug"); err != nil {
@@ -92,6 +203,9 @@ func (qmd *Qmd) Close() {
 	close(qmd.ClosingWorkers)
 	qmd.WaitWorkers.Wait()
 
+	close(qmd.ClosingCallbacks)
+	qmd.WaitCallbacks.Wait()
+
 	qmd.DB.Close()
 	qmd.Queue.Close()
 }
@@ -100,15 +214,117 @@ func (qmd *Qmd) GetScript(file string) (string, error) {
 	return qmd.Scripts.Get(file)
 }
 
-// TODO: Use fsnotify.
+const (
+	// scriptsRescanInterval is the fallback rescan of script_dir,
+	// in case some change wasn't caught by the watcher.
+	scriptsRescanInterval = time.Minute
+	// scriptsDebounce is how long to wait for the changes
+	// in script_dir to settle down before rescanning it.
+	scriptsDebounce = 500 * time.Millisecond
+	// scriptsMaxBackoff is the max delay between failed rescans.
+	scriptsMaxBackoff = 5 * time.Minute
+)
+
+// WatchScripts keeps the scripts cache up to date. It rescans script_dir
+// on filesystem notifications, and periodically as a fall-back.
 func (qmd *Qmd) WatchScripts() {
+	dir := qmd.Config.ScriptDir
+
+	var events <-chan struct{}
+	watcher, err := newDirWatcher()
+	if err != nil {
+		lg.Errorf("Scripts:\tcan't watch script_dir, rescanning every %v: %v", scriptsRescanInterval, err)
+	} else {
+		events = watcher.Events
+	}
+
+	backoff := time.Duration(0)
+	rescan := time.NewTimer(0)
 	for {
-		if err := qmd.Scripts.Update(qmd.Config.ScriptDir); err != nil {
-			lg.Error(err)
-			continue
+		select {
+		case _, ok := <-events:
+			if !ok {
+				lg.Errorf("Scripts:\tstopped watching script_dir, rescanning every %v", scriptsRescanInterval)
+				events = nil
+				watcher = nil
+				break
+			}
+			resetTimer(rescan, scriptsDebounce)
+
+		case <-rescan.C:
+			if err := qmd.Scripts.Update(dir); err != nil {
+				// Back off, so we don't flood the log (and Slack).
+				backoff = 2 * backoff
+				if backoff == 0 {
+					backoff = time.Second
+				}
+				if backoff > scriptsMaxBackoff {
+					backoff = scriptsMaxBackoff
+				}
+				lg.Errorf("%v (retrying in %v)", err, backoff)
+				rescan.Reset(backoff)
+				break
+			}
+			backoff = 0
+
+			// Pick up new subdirectories.
+			if watcher != nil {
+				if err := watcher.AddTree(dir); err != nil {
+					lg.Errorf("Scripts:\tcan't watch script_dir: %v", err)
+				}
+			}
+			rescan.Reset(scriptsRescanInterval)
+		}
+	}
+}
+
+// scriptsChangeTimeout is timeout of the on_change_url requests.
+const scriptsChangeTimeout = 30 * time.Second
+
+// notifyScriptsChange POSTs the scripts change to on_change_url, along
+// with URL of the QMD node. The request is signed like the callbacks.
+func (qmd *Qmd) notifyScriptsChange(change ScriptsChange) {
+	data, err := json.Marshal(struct {
+		URL string `json:"url"`
+		ScriptsChange
+	}{qmd.Config.URL, change})
+	if err != nil {
+		lg.Errorf("Scripts:\tcan't encode change: %v", err)
+		return
+	}
+
+	url := qmd.Config.Scripts.OnChangeURL
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		lg.Errorf("Scripts:\tcan't notify %v: %v", url, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := qmd.Config.Callback.Secret; secret != "" {
+		signature.SignRequest(req, []byte(secret), data)
+	}
+
+	client := &http.Client{Timeout: scriptsChangeTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		lg.Errorf("Scripts:\tcan't notify %v: %v", url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		lg.Errorf("Scripts:\tcan't notify %v: %v", url, resp.Status)
+	}
+}
+
+// resetTimer resets the timer, which might have fired already.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
 		}
-		time.Sleep(10 * time.Second)
 	}
+	t.Reset(d)
 }
 
 func (qmd *Qmd) ClosingResponder(h http.Handler) http.Handler {
@@ -1,16 +1,83 @@
 package qmd
 
 import (
-	"bytes"
 	"encoding/json"
-	"net/http"
+	"errors"
+	"fmt"
+	"time"
 
-	"github.com/goware/disque"
 	"github.com/goware/lg"
 
+	"github.com/pressly/qmd/config"
 	"github.com/pressly/qmd/rest/api"
 )
 
+var (
+	ErrQueueTimeout = errors.New("queue: timeout")
+	ErrQueueClosed  = errors.New("queue: closed")
+)
+
+// Priorities lists the queue priorities, from the most important one.
+var Priorities = []string{"urgent", "high", "low"}
+
+// Job is a unit of work passed through the Queue.
+type Job struct {
+	ID    string
+	Data  string
+	Queue string
+
+	limit string // Limit the job is counted against, see acquireLimit.
+}
+
+// Queue is a priority queue of jobs shared by QMD workers.
+type Queue interface {
+	// Add enqueues data with a given priority. The job is requeued,
+	// if it's not ACKed within retryAfter since it was dequeued; zero
+	// retryAfter means the queue's default.
+	Add(data string, priority string, retryAfter time.Duration) (*Job, error)
+	// Get dequeues a job, trying the priorities in the given order.
+	// It returns ErrQueueTimeout if there is no job available.
+	Get(priorities ...string) (*Job, error)
+	// Ack marks the job as done and removes it from the queue,
+	// even if it wasn't dequeued yet.
+	Ack(job *Job) error
+	// Nack puts the job back to the queue.
+	Nack(job *Job) error
+	// Defer puts the dequeued job back to the queue, but it's not
+	// available to Get until delay has passed.
+	Defer(job *Job, delay time.Duration) error
+	// Fetch returns the queued or dequeued (not yet ACKed) job,
+	// or ErrNotFound.
+	Fetch(ID string) (*Job, error)
+	// Wait blocks until the job is ACKed.
+	Wait(job *Job) error
+	// Len returns number of queued jobs of a given priority.
+	Len(priority string) (int, error)
+	// ActiveLen returns number of dequeued, but not yet ACKed, jobs
+	// of a given priority.
+	ActiveLen(priority string) (int, error)
+
+	Ping() error
+	Close()
+}
+
+// retryMargin is added to the job's timeout to get its retry window,
+// so the worker has time to kill the job and save the response.
+const retryMargin = 30 * time.Second
+
+// NewQueue creates Queue backend specified in config.
+func NewQueue(conf *config.Config) (Queue, error) {
+	retryAfter := time.Duration(conf.MaxExecTime) * time.Second
+
+	switch conf.Queue.Backend {
+	case "", "disque":
+		return NewDisqueQueue(conf.Queue.DisqueURI, retryAfter)
+	case "memory":
+		return NewMemoryQueue(time.Second), nil
+	}
+	return nil, fmt.Errorf("queue: unknown backend \"%v\"", conf.Queue.Backend)
+}
+
 func (qmd *Qmd) ListenQueue() {
 	qmd.WaitListenQueue.Add(1)
 	defer qmd.WaitListenQueue.Done()
@@ -28,6 +95,16 @@ func (qmd *Qmd) ListenQueue() {
 				break
 			}
 			lg.Debugf("Queue:\tDequeued job %v", job.ID)
+			if !qmd.acquireLimit(job) {
+				// Let the job wait in the queue for a while,
+				// and pick other work meanwhile.
+				if err := qmd.Queue.Defer(job, limitRetryDelay); err != nil {
+					lg.Errorf("Queue:\tcan't defer job %v: %v", job.ID, err)
+				}
+				lg.Debugf("Queue:\tDeferred job %v, its script is at the limit", job.ID)
+				qmd.Workers <- worker
+				break
+			}
 			// Send the job to the worker.
 			worker <- job
 
@@ -38,29 +115,35 @@ func (qmd *Qmd) ListenQueue() {
 	}
 }
 
-func (qmd *Qmd) Enqueue(data string, priority string) (*disque.Job, error) {
-	return qmd.Queue.Add(data, priority)
+// Enqueue adds the script's job to the queue. The job is not requeued,
+// while it's running for up to timeout (and being killed afterwards).
+func (qmd *Qmd) Enqueue(data string, priority string, timeout time.Duration) (*Job, error) {
+	grace := time.Duration(orDefault(qmd.Config.KillGrace, defaultKillGracePeriod)) * time.Second
+	return qmd.Queue.Add(data, priority, timeout+grace+retryMargin)
 }
 
-func (qmd *Qmd) Dequeue() (*disque.Job, error) {
-	return qmd.Queue.Get("urgent", "high", "low")
+func (qmd *Qmd) Dequeue() (*Job, error) {
+	return qmd.Queue.Get(Priorities...)
 }
 
 func (qmd *Qmd) GetResponse(ID string) ([]byte, error) {
-	if err := qmd.Queue.Wait(&disque.Job{ID: ID}); err != nil {
+	if err := qmd.Queue.Wait(&Job{ID: ID}); err != nil {
 		return nil, err
 	}
 
 	return qmd.DB.GetResponse(ID)
 }
 
-func (qmd *Qmd) GetAsyncResponse(req *api.ScriptsRequest, ID string) ([]byte, error) {
+func (qmd *Qmd) GetAsyncResponse(req *api.ScriptsRequest, ID string, priority string) ([]byte, error) {
 	resp := api.ScriptsResponse{
 		ID:          ID,
+		Priority:    priority,
 		Script:      req.Script,
 		Args:        req.Args,
 		Files:       req.Files,
 		CallbackURL: req.CallbackURL,
+		CreatedBy:   req.CreatedBy,
+		Timeout:     req.Timeout,
 		Status:      "QUEUED",
 	}
 	data, err := json.Marshal(resp)
@@ -69,21 +152,3 @@ func (qmd *Qmd) GetAsyncResponse(req *api.ScriptsRequest, ID string) ([]byte, er
 	}
 	return data, nil
 }
-
-func (qmd *Qmd) PostResponseCallback(req *api.ScriptsRequest, ID string) error {
-	if err := qmd.Queue.Wait(&disque.Job{ID: ID}); err != nil {
-		return err
-	}
-
-	data, err := qmd.DB.GetResponse(ID)
-	if err != nil {
-		return err
-	}
-
-	_, err = http.Post(req.CallbackURL, "application/json", bytes.NewReader(data))
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
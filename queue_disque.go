@@ -0,0 +1,130 @@
+package qmd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/goware/disque"
+)
+
+// DisqueQueue is a Queue backed by Disque cluster.
+type DisqueQueue struct {
+	pool *disque.Pool
+	conf disque.Config
+
+	mu       sync.Mutex           // guards deferred
+	deferred map[*Job]*time.Timer // Map of deferred jobs to their NACK timers.
+}
+
+func NewDisqueQueue(address string, retryAfter time.Duration) (*DisqueQueue, error) {
+	pool, err := disque.New(address)
+	if err != nil {
+		return nil, err
+	}
+	conf := disque.Config{
+		RetryAfter: retryAfter,
+		Timeout:    time.Second,
+	}
+	pool.Use(conf)
+	return &DisqueQueue{pool: pool, conf: conf, deferred: map[*Job]*time.Timer{}}, nil
+}
+
+func (q *DisqueQueue) Add(data string, priority string, retryAfter time.Duration) (*Job, error) {
+	pool := q.pool
+	if retryAfter > 0 {
+		conf := q.conf
+		conf.RetryAfter = retryAfter
+		pool = pool.With(conf)
+	}
+	job, err := pool.Add(data, priority)
+	if err != nil {
+		return nil, err
+	}
+	return fromDisqueJob(job), nil
+}
+
+func (q *DisqueQueue) Get(priorities ...string) (*Job, error) {
+	job, err := q.pool.Get(priorities...)
+	if err != nil {
+		return nil, err
+	}
+	return fromDisqueJob(job), nil
+}
+
+func (q *DisqueQueue) Ack(job *Job) error {
+	return q.pool.Ack(toDisqueJob(job))
+}
+
+func (q *DisqueQueue) Nack(job *Job) error {
+	return q.pool.Nack(toDisqueJob(job))
+}
+
+// Defer NACKs the job after delay. Disque can't delay the NACK itself,
+// so the job is held by this node (and counted as active) meanwhile.
+func (q *DisqueQueue) Defer(job *Job, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.deferred[job] = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		delete(q.deferred, job)
+		q.mu.Unlock()
+		q.Nack(job)
+	})
+	return nil
+}
+
+func (q *DisqueQueue) Fetch(ID string) (*Job, error) {
+	job, err := q.pool.Fetch(ID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return fromDisqueJob(job), nil
+}
+
+func (q *DisqueQueue) Wait(job *Job) error {
+	return q.pool.Wait(toDisqueJob(job))
+}
+
+func (q *DisqueQueue) Len(priority string) (int, error) {
+	return q.pool.Len(priority)
+}
+
+func (q *DisqueQueue) ActiveLen(priority string) (int, error) {
+	return q.pool.ActiveLen(priority)
+}
+
+func (q *DisqueQueue) Ping() error {
+	return q.pool.Ping()
+}
+
+// Close NACKs the deferred jobs right away, so they don't wait for
+// the retry.
+func (q *DisqueQueue) Close() {
+	q.mu.Lock()
+	for job, timer := range q.deferred {
+		if timer.Stop() {
+			q.Nack(job)
+		}
+		delete(q.deferred, job)
+	}
+	q.mu.Unlock()
+
+	q.pool.Close()
+}
+
+func fromDisqueJob(job *disque.Job) *Job {
+	return &Job{
+		ID:    job.ID,
+		Data:  job.Data,
+		Queue: job.Queue,
+	}
+}
+
+func toDisqueJob(job *Job) *disque.Job {
+	return &disque.Job{
+		ID:    job.ID,
+		Data:  job.Data,
+		Queue: job.Queue,
+	}
+}
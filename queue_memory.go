@@ -0,0 +1,240 @@
+package qmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// MemoryQueue is an in-process Queue. It's meant for single-node
+// deployments and tests, as the jobs don't survive QMD restart.
+type MemoryQueue struct {
+	timeout time.Duration
+
+	mu     sync.Mutex               // guards the fields below
+	queued map[string][]*Job        // Map of priorities to queued jobs.
+	active map[string]*Job          // Map of IDs to dequeued jobs.
+	due    map[string]time.Time     // Map of IDs to due times of deferred jobs.
+	done   map[string]chan struct{} // Map of IDs to channels closed on ACK.
+	added  chan struct{}            // Closed (and replaced) when a job becomes available.
+	stop   chan struct{}            // Closed by Close, so Wait() callers return.
+	closed bool
+}
+
+// NewMemoryQueue creates empty in-process queue. Get() blocks
+// for up to timeout, if there are no jobs available.
+func NewMemoryQueue(timeout time.Duration) *MemoryQueue {
+	return &MemoryQueue{
+		timeout: timeout,
+		queued:  map[string][]*Job{},
+		active:  map[string]*Job{},
+		due:     map[string]time.Time{},
+		done:    map[string]chan struct{}{},
+		added:   make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Add enqueues the job. Dequeued jobs are never requeued, as they
+// can't outlive QMD anyway, so retryAfter is ignored.
+func (q *MemoryQueue) Add(data string, priority string, retryAfter time.Duration) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+
+	job := &Job{
+		ID:    newJobID(),
+		Data:  data,
+		Queue: priority,
+	}
+	q.queued[priority] = append(q.queued[priority], job)
+	q.done[job.ID] = make(chan struct{})
+	q.notify()
+
+	return job, nil
+}
+
+func (q *MemoryQueue) Get(priorities ...string) (*Job, error) {
+	timeout := time.After(q.timeout)
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, ErrQueueClosed
+		}
+		now := time.Now()
+		for _, priority := range priorities {
+			jobs := q.queued[priority]
+			for i, job := range jobs {
+				if due, ok := q.due[job.ID]; ok {
+					if now.Before(due) {
+						continue
+					}
+					delete(q.due, job.ID)
+				}
+				q.queued[priority] = append(jobs[:i:i], jobs[i+1:]...)
+				q.active[job.ID] = job
+				q.mu.Unlock()
+				return job, nil
+			}
+		}
+		added := q.added
+		q.mu.Unlock()
+
+		select {
+		case <-added:
+		case <-timeout:
+			return nil, ErrQueueTimeout
+		}
+	}
+}
+
+func (q *MemoryQueue) Ack(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.active, job.ID)
+	delete(q.due, job.ID)
+	for priority, jobs := range q.queued {
+		for i, queued := range jobs {
+			if queued.ID == job.ID {
+				q.queued[priority] = append(jobs[:i:i], jobs[i+1:]...)
+				break
+			}
+		}
+	}
+	if done, ok := q.done[job.ID]; ok {
+		close(done)
+		delete(q.done, job.ID)
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Nack(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	active, ok := q.active[job.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(q.active, job.ID)
+	q.queued[active.Queue] = append([]*Job{active}, q.queued[active.Queue]...)
+	q.notify()
+
+	return nil
+}
+
+// Defer puts the dequeued job back to the queue. Get skips the job
+// until delay has passed.
+func (q *MemoryQueue) Defer(job *Job, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	active, ok := q.active[job.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(q.active, job.ID)
+	q.queued[active.Queue] = append([]*Job{active}, q.queued[active.Queue]...)
+	q.due[job.ID] = time.Now().Add(delay)
+
+	// Wake up the Get() callers, once the job is due.
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.notify()
+	})
+
+	return nil
+}
+
+func (q *MemoryQueue) Fetch(ID string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job, ok := q.active[ID]; ok {
+		return job, nil
+	}
+	for _, jobs := range q.queued {
+		for _, job := range jobs {
+			if job.ID == ID {
+				return job, nil
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Wait blocks until the job is ACKed, or returns ErrQueueClosed
+// when the queue is closed.
+func (q *MemoryQueue) Wait(job *Job) error {
+	q.mu.Lock()
+	done, ok := q.done[job.ID]
+	q.mu.Unlock()
+
+	if !ok {
+		// Unknown or already ACKed job.
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-q.stop:
+		return ErrQueueClosed
+	}
+}
+
+func (q *MemoryQueue) Len(priority string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.queued[priority]), nil
+}
+
+func (q *MemoryQueue) ActiveLen(priority string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, job := range q.active {
+		if job.Queue == priority {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (q *MemoryQueue) Ping() error {
+	return nil
+}
+
+func (q *MemoryQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.stop)
+	q.notify()
+}
+
+// notify wakes up all the Get() callers. Caller must hold q.mu.
+func (q *MemoryQueue) notify() {
+	close(q.added)
+	q.added = make(chan struct{})
+}
+
+func newJobID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "MQ" + hex.EncodeToString(b)
+}
@@ -0,0 +1,154 @@
+package qmd_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pressly/qmd"
+)
+
+func TestMemoryQueuePriorities(t *testing.T) {
+	q := qmd.NewMemoryQueue(10 * time.Millisecond)
+	defer q.Close()
+
+	low, _ := q.Add("low", "low", 0)
+	high, _ := q.Add("high", "high", 0)
+	urgent, _ := q.Add("urgent", "urgent", 0)
+
+	if n, _ := q.Len("high"); n != 1 {
+		t.Errorf(`expected 1, got %v`, n)
+	}
+
+	for _, expected := range []*qmd.Job{urgent, high, low} {
+		job, err := q.Get(qmd.Priorities...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.ID != expected.ID {
+			t.Errorf(`expected "%s" job, got "%s"`, expected.Data, job.Data)
+		}
+	}
+
+	if _, err := q.Get(qmd.Priorities...); err != qmd.ErrQueueTimeout {
+		t.Errorf(`expected "%v", got "%v"`, qmd.ErrQueueTimeout, err)
+	}
+	if n, _ := q.ActiveLen("low"); n != 1 {
+		t.Errorf(`expected 1, got %v`, n)
+	}
+
+	// NACKed job is available again.
+	if err := q.Nack(low); err != nil {
+		t.Error(err)
+	}
+	job, err := q.Get("low")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != low.ID {
+		t.Error("unexpected value")
+	}
+}
+
+func TestMemoryQueueWait(t *testing.T) {
+	q := qmd.NewMemoryQueue(10 * time.Millisecond)
+	defer q.Close()
+
+	job, _ := q.Add("data", "high", 0)
+
+	done := make(chan struct{})
+	go func() {
+		q.Wait(job)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Wait() returned before ACK")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Get() blocks until a job is added.
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		q.Add("data", "low", 0)
+	}()
+	for i := 0; i < 2; i++ {
+		if _, err := q.Get(qmd.Priorities...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q.Ack(job)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait() didn't return after ACK")
+	}
+}
+
+func TestMemoryQueueClose(t *testing.T) {
+	q := qmd.NewMemoryQueue(10 * time.Millisecond)
+
+	job, _ := q.Add("data", "high", 0)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Wait(job)
+	}()
+
+	q.Close()
+
+	select {
+	case err := <-done:
+		if err != qmd.ErrQueueClosed {
+			t.Errorf("Wait() = %v, want %v", err, qmd.ErrQueueClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait() didn't return after Close()")
+	}
+
+	// Closing twice is harmless.
+	q.Close()
+}
+
+func TestMemoryQueueDefer(t *testing.T) {
+	q := qmd.NewMemoryQueue(10 * time.Millisecond)
+	defer q.Close()
+
+	first, _ := q.Add("first", "low", 0)
+	second, _ := q.Add("second", "low", 0)
+
+	job, err := q.Get("low")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Defer(job, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deferred job stays queued, but the next job is dequeued first.
+	if n, _ := q.Len("low"); n != 2 {
+		t.Errorf(`expected 2, got %v`, n)
+	}
+	job, err = q.Get("low")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != second.ID {
+		t.Errorf(`expected "%s" job, got "%s"`, second.Data, job.Data)
+	}
+	if _, err := q.Get("low"); err != qmd.ErrQueueTimeout {
+		t.Errorf(`expected "%v", got "%v"`, qmd.ErrQueueTimeout, err)
+	}
+
+	// It's available again after the delay.
+	time.Sleep(100 * time.Millisecond)
+	job, err = q.Get("low")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != first.ID {
+		t.Errorf(`expected "%s" job, got "%s"`, first.Data, job.Data)
+	}
+}
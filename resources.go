@@ -0,0 +1,220 @@
+package qmd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goware/lg"
+
+	"github.com/pressly/qmd/config"
+)
+
+// cpuPeriod is the cgroup cpu.max period in microseconds.
+const cpuPeriod = 100000
+
+// resources returns resource limits of the script's jobs. Each limit
+// is taken from the script's manifest, or from the first [[limits]]
+// config section matching the script that sets it, or from the
+// [resources] config section.
+func (qmd *Qmd) resources(script string) config.Resources {
+	var sources []config.Resources
+	if m, _ := qmd.Scripts.Manifest(script); m != nil && m.Resources != nil {
+		sources = append(sources, *m.Resources)
+	}
+	for _, limit := range qmd.Config.Limits {
+		if ok, _ := path.Match(limit.Script, script); ok {
+			sources = append(sources, limit.Resources)
+		}
+	}
+	sources = append(sources, qmd.Config.Resources)
+
+	var r config.Resources
+	for _, s := range sources {
+		if r.AddressSpace == 0 {
+			r.AddressSpace = s.AddressSpace
+		}
+		if r.CPUTime == 0 {
+			r.CPUTime = s.CPUTime
+		}
+		if r.OpenFiles == 0 {
+			r.OpenFiles = s.OpenFiles
+		}
+		if r.Processes == 0 {
+			r.Processes = s.Processes
+		}
+		if r.Memory == 0 {
+			r.Memory = s.Memory
+		}
+		if r.CPUs == 0 {
+			r.CPUs = s.CPUs
+		}
+	}
+	return r
+}
+
+// initCgroups enables the memory and cpu controllers for the jobs'
+// cgroups in cgroup_dir. It returns the directory, or empty string
+// if cgroups are not available.
+func initCgroups(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	err := func() error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(dir, "cgroup.controllers")); err != nil {
+			return fmt.Errorf("not a cgroup v2 directory")
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644); err != nil {
+			return err
+		}
+		return probeCgroups(dir)
+	}()
+	if err != nil {
+		lg.Warnf("Cgroups:\tcgroup_dir=\"%v\": %v; memory and cpus limits are disabled", dir, err)
+		return ""
+	}
+	return dir
+}
+
+// limit sets up the cmd's resource limits. The cmd is started in the job's
+// cgroup and wrapped in bash, which sets the rlimits before it execs the
+// script.
+func (cmd *Cmd) limit() error {
+	r := cmd.Resources
+
+	var steps []string
+	if r.AddressSpace > 0 {
+		steps = append(steps, fmt.Sprintf("ulimit -v %d", r.AddressSpace*1024))
+	}
+	if r.CPUTime > 0 {
+		// The soft limit sends SIGXCPU, so we can tell the limit
+		// was hit. The hard limit kills the scripts that trap it.
+		steps = append(steps, fmt.Sprintf("ulimit -S -t %d", r.CPUTime))
+		steps = append(steps, fmt.Sprintf("ulimit -H -t %d", r.CPUTime+1))
+	}
+	if r.OpenFiles > 0 {
+		steps = append(steps, fmt.Sprintf("ulimit -n %d", r.OpenFiles))
+	}
+	if r.Processes > 0 {
+		steps = append(steps, fmt.Sprintf("ulimit -u %d", r.Processes))
+	}
+
+	if cmd.CgroupDir != "" && (r.Memory > 0 || r.CPUs > 0) {
+		cgroup := filepath.Join(cmd.CgroupDir, cmd.JobID)
+		err := os.Mkdir(cgroup, 0755)
+		if os.IsExist(err) {
+			// The job was redelivered after QMD crashed. Kill
+			// whatever is left of its previous run and start over.
+			cmd.cgroup = cgroup
+			cmd.removeCgroup()
+			err = os.Mkdir(cgroup, 0755)
+		}
+		if err != nil {
+			return err
+		}
+		cmd.cgroup = cgroup
+		if r.Memory > 0 {
+			if err := writeCgroup(cgroup, "memory.max", strconv.Itoa(r.Memory*1024*1024)); err != nil {
+				return err
+			}
+			// Don't let the job swap instead; needs swap accounting.
+			writeCgroup(cgroup, "memory.swap.max", "0")
+		}
+		if r.CPUs > 0 {
+			quota := fmt.Sprintf("%d %d", int(r.CPUs*cpuPeriod), cpuPeriod)
+			if err := writeCgroup(cgroup, "cpu.max", quota); err != nil {
+				return err
+			}
+		}
+		if err := cmd.startInCgroup(cgroup); err != nil {
+			return err
+		}
+	}
+
+	if len(steps) == 0 {
+		return nil
+	}
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		return err
+	}
+	script := strings.Join(steps, " && ") + ` && exec "$0" "$@"`
+	cmd.Cmd.Args = append([]string{"bash", "-c", script, cmd.Cmd.Path}, cmd.Cmd.Args[1:]...)
+	cmd.Cmd.Path = bash
+	return nil
+}
+
+// limitsHit returns the resource limits the finished cmd has hit.
+func (cmd *Cmd) limitsHit() []string {
+	var hit []string
+	if cmd.Signal == "SIGXCPU" {
+		hit = append(hit, "cpu_time")
+	}
+	if cmd.cgroup != "" {
+		if readCgroupStat(cmd.cgroup, "memory.events", "oom_kill") > 0 {
+			hit = append(hit, "memory")
+		}
+		if readCgroupStat(cmd.cgroup, "cpu.stat", "nr_throttled") > 0 {
+			hit = append(hit, "cpus")
+		}
+	}
+	return hit
+}
+
+// removeCgroup kills the processes left in the cmd's cgroup
+// and removes it.
+func (cmd *Cmd) removeCgroup() {
+	if cmd.cgroup == "" {
+		return
+	}
+	if cmd.cgroupFile != nil {
+		cmd.cgroupFile.Close()
+		cmd.cgroupFile = nil
+	}
+	writeCgroup(cmd.cgroup, "cgroup.kill", "1")
+
+	// The killed processes might take a while to leave the cgroup.
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(cmd.cgroup); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	lg.Errorf("Cmd:\tCan't remove cgroup of %v: %v", cmd.JobID, err)
+}
+
+func writeCgroup(cgroup string, file string, value string) error {
+	return ioutil.WriteFile(filepath.Join(cgroup, file), []byte(value), 0644)
+}
+
+// readCgroupStat returns value of a given key of a flat keyed
+// cgroup file, e.g. "oom_kill 1" line of memory.events.
+func readCgroupStat(cgroup string, file string, key string) int {
+	f, err := os.Open(filepath.Join(cgroup, file))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
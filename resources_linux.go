@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package qmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// startInCgroup makes the cmd start right in the cgroup, so none of its
+// processes run outside of it, even the ones forked before the cmd execs
+// the script.
+func (cmd *Cmd) startInCgroup(cgroup string) error {
+	f, err := os.Open(cgroup)
+	if err != nil {
+		return err
+	}
+	cmd.cgroupFile = f
+	cmd.Cmd.SysProcAttr.UseCgroupFD = true
+	cmd.Cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return nil
+}
+
+// probeCgroups checks the processes can be started in a cgroup in dir,
+// which needs Linux 5.7+.
+func probeCgroups(dir string) error {
+	bin, err := exec.LookPath("true")
+	if err != nil {
+		return err
+	}
+	cgroup := filepath.Join(dir, "qmd-probe")
+	if err := os.Mkdir(cgroup, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	defer os.Remove(cgroup)
+
+	f, err := os.Open(cgroup)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd := exec.Command(bin)
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(f.Fd())}
+	return cmd.Run()
+}
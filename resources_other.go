@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package qmd
+
+import "errors"
+
+func (cmd *Cmd) startInCgroup(cgroup string) error {
+	return errors.New("cgroups: supported on linux only")
+}
+
+func probeCgroups(dir string) error {
+	return errors.New("supported on linux only")
+}
@@ -0,0 +1,42 @@
+package api
+
+import "time"
+
+// JobsStats is the JSON version of GET /jobs.
+type JobsStats struct {
+	// Number of jobs per priority, in the whole QMD cluster.
+	Queued   map[string]int `json:"queued"`
+	Running  map[string]int `json:"running"`
+	Finished map[string]int `json:"finished"`
+	// Number of all the finished jobs, and the ones still in the DB.
+	Total  int `json:"total"`
+	Cached int `json:"cached"`
+
+	// Stats of the QMD node that served the request.
+	Node NodeStats `json:"node"`
+}
+
+type NodeStats struct {
+	Workers     map[string]int          `json:"workers"` // "busy" and "idle".
+	Scripts     map[string]*ScriptStats `json:"scripts"`
+	RunningJobs []*RunningJob           `json:"running_jobs"`
+}
+
+type ScriptStats struct {
+	Running  int `json:"running"`
+	Finished int `json:"finished"`
+}
+
+type RunningJob struct {
+	ID        string    `json:"id"`
+	Script    string    `json:"script"`
+	Priority  string    `json:"priority"`
+	StartTime time.Time `json:"start_time"`
+}
+
+// JobsList is a page of the job history.
+type JobsList struct {
+	Jobs []*ScriptsResponse `json:"jobs"`
+	// Cursor of the next page; empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
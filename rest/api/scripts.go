@@ -6,7 +6,22 @@ type ScriptsRequest struct {
 	Script      string            `json:"script"`
 	Args        []string          `json:"args,omitempty"`
 	Files       map[string]string `json:"files,omitempty"`
+	FilesBase64 map[string]string `json:"files_base64,omitempty"` // Base64 encoded binary files.
+	Env         map[string]string `json:"env,omitempty"`          // Allowed by the script's manifest.
+	Stdin       string            `json:"stdin,omitempty"`
+	StdinBase64 string            `json:"stdin_base64,omitempty"` // Base64 encoded binary stdin.
 	CallbackURL string            `json:"callback_url,omitempty"`
+	Timeout     int               `json:"timeout,omitempty"` // In seconds.
+
+	// Uploads are names of the files uploaded in the multipart request
+	// or in FilesBase64, staged in Staging until the job runs. They're
+	// set by QMD, not by the client.
+	Uploads []string `json:"uploads,omitempty"`
+	Staging string   `json:"staging,omitempty"`
+
+	// CreatedBy is name of the API token the job was created with.
+	// It's set by QMD, not by the client.
+	CreatedBy string `json:"created_by,omitempty"`
 }
 
 type JobScriptsRequest struct {
@@ -24,11 +39,65 @@ type ScriptsResponse struct {
 	Files  map[string]string `json:"files,omitempty"`
 
 	CallbackURL string    `json:"callback_url,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	Uploads     []string  `json:"uploads,omitempty"`
+	Priority    string    `json:"priority,omitempty"`
+	Timeout     int       `json:"timeout,omitempty"` // In seconds.
 	Status      string    `json:"status"`
 	StartTime   time.Time `json:"start_time,omitempty"`
 	EndTime     time.Time `json:"end_time,omitempty"`
 	Duration    string    `json:"duration,omitempty"`
 	QmdOut      string    `json:"output,omitempty"`
-	ExecLog     string    `json:"exec_log,omitempty"`
+	ExecLog     string    `json:"exec_log,omitempty"` // Combined stdout and stderr.
+	Stdout      string    `json:"stdout,omitempty"`
+	Stderr      string    `json:"stderr,omitempty"`
 	Err         string    `json:"error,omitempty"`
+
+	// Why the job ended, if not on its own.
+	Signal    string `json:"signal,omitempty"` // The signal that ended the script, e.g. "SIGTERM".
+	TimedOut  bool   `json:"timed_out,omitempty"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+
+	// Truncated is true, if exec_log, stdout, stderr, output or lines
+	// were truncated to fit the size limits.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Artifacts lists the files saved from the job's QMD_TMP,
+	// see GET /jobs/:id/artifacts.
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+
+	// Lines is the timestamped log of the output lines,
+	// if enabled by line_log in the config.
+	Lines []LogLine `json:"lines,omitempty"`
+
+	// LimitsHit lists the resource limits the job has hit:
+	// "cpu_time", "memory" or "cpus".
+	LimitsHit []string `json:"limits_hit,omitempty"`
+
+	Callback *CallbackStatus `json:"callback,omitempty"`
+}
+
+// Artifact is a file saved from the job's QMD_TMP.
+type Artifact struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"` // In bytes.
+}
+
+// LogLine is a line of the script's output.
+type LogLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"` // "stdout" or "stderr"
+	Text   string    `json:"text"`
+}
+
+// CallbackStatus tracks delivery of the response to callback_url.
+type CallbackStatus struct {
+	Status   string            `json:"status"` // PENDING, DELIVERED or FAILED
+	Attempts []CallbackAttempt `json:"attempts,omitempty"`
+}
+
+type CallbackAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Err        string    `json:"error,omitempty"`
 }
@@ -0,0 +1,79 @@
+package rest
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/pressly/chi"
+	"github.com/pressly/qmd"
+	"github.com/pressly/qmd/rest/handlers"
+)
+
+// Authenticate checks the "Authorization: Bearer <token>" header, if auth
+// is enabled, and stores the token in the context under "token" key.
+func Authenticate(next chi.Handler) chi.Handler {
+	fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if !handlers.Qmd.Config.Auth.Enabled {
+			next.ServeHTTPC(ctx, w, r)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			unauthorized(w)
+			return
+		}
+
+		token, err := handlers.Qmd.Authenticate(strings.TrimPrefix(auth, "Bearer "))
+		if err == qmd.ErrUnauthorized {
+			unauthorized(w)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		ctx = context.WithValue(ctx, "token", token)
+		next.ServeHTTPC(ctx, w, r)
+	}
+
+	return chi.HandlerFunc(fn)
+}
+
+// ScriptAccess allows only the tokens that can run the :filename script.
+func ScriptAccess(next chi.Handler) chi.Handler {
+	fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if token, ok := ctx.Value("token").(*qmd.Token); ok {
+			if !token.CanRun(chi.URLParams(ctx)["filename"]) {
+				http.Error(w, http.StatusText(403), 403)
+				return
+			}
+		}
+		next.ServeHTTPC(ctx, w, r)
+	}
+
+	return chi.HandlerFunc(fn)
+}
+
+// JobsAccess allows only the tokens with access to jobs.
+func JobsAccess(next chi.Handler) chi.Handler {
+	fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if token, ok := ctx.Value("token").(*qmd.Token); ok {
+			if !token.Jobs {
+				http.Error(w, http.StatusText(403), 403)
+				return
+			}
+		}
+		next.ServeHTTPC(ctx, w, r)
+	}
+
+	return chi.HandlerFunc(fn)
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="qmd"`)
+	http.Error(w, http.StatusText(401), 401)
+}
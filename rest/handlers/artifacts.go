@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	"github.com/pressly/chi"
+	"github.com/pressly/qmd"
+)
+
+func JobArtifacts(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if Qmd.Artifacts == nil {
+		http.Error(w, qmd.ErrNotFound.Error(), 404)
+		return
+	}
+
+	artifacts, err := Qmd.Artifacts.List(chi.URLParams(ctx)["id"])
+	if err == qmd.ErrNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(artifacts)
+}
+
+func JobArtifact(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if Qmd.Artifacts == nil {
+		http.Error(w, qmd.ErrNotFound.Error(), 404)
+		return
+	}
+	name := chi.URLParams(ctx)["name"]
+
+	f, size, err := Qmd.Artifacts.Open(chi.URLParams(ctx)["id"], name)
+	if err == qmd.ErrNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, f)
+}
@@ -1,10 +1,20 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/goware/lg"
 	"golang.org/x/net/context"
+
+	"github.com/pressly/chi"
+	"github.com/pressly/qmd"
+	"github.com/pressly/qmd/rest/api"
 )
 
 func Job(ctx context.Context, w http.ResponseWriter, r *http.Request) {
@@ -18,19 +28,176 @@ func Job(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
+func JobLog(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParams(ctx)["id"]
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	var stop <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		stop = cn.CloseNotify()
+	}
+
+	err := Qmd.FollowLog(id, flushWriter{w}, stop)
+	if err == qmd.ErrNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err != nil {
+		lg.Errorf("Handler:\tcan't stream log of job %v: %v", id, err)
+	}
+}
+
+// flushWriter flushes every write to the client right away,
+// so it's sent as a HTTP chunk.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+func CancelJob(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParams(ctx)["id"]
+
+	err := Qmd.Cancel(id)
+	switch err {
+	case nil:
+	case qmd.ErrNotFound:
+		http.Error(w, err.Error(), 404)
+		return
+	case qmd.ErrJobFinished:
+		http.Error(w, err.Error(), 409)
+		return
+	default:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// Wait for the worker to kill the job.
+	resp, err := Qmd.GetResponse(id)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 1000
+)
+
+// historyParams are query params of the job history search.
+var historyParams = []string{"script", "status", "since", "until", "limit", "cursor"}
+
+// Jobs responds with stats of the jobs; JSON if the client accepts
+// application/json or asks for ?format=json, plain text otherwise.
+// Requests with any of the historyParams search the job history.
 func Jobs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	low, _ := Qmd.Queue.Len("low")
-	high, _ := Qmd.Queue.Len("high")
-	urgent, _ := Qmd.Queue.Len("urgent")
-	lowActive, _ := Qmd.Queue.ActiveLen("low")
-	highActive, _ := Qmd.Queue.ActiveLen("high")
-	urgentActive, _ := Qmd.Queue.ActiveLen("urgent")
-	cached, _ := Qmd.DB.Len()
-	finished, _ := Qmd.DB.TotalLen()
-
-	r.Header.Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, "Queued: %v\n- %v (urgent)\n- %v (high)\n- %v (low)\n\n", urgent+high+low, urgent, high, low)
-	fmt.Fprintf(w, "Running: %v\n- %v (urgent)\n- %v (high)\n- %v (low)\n\n", urgentActive+highActive+lowActive, urgentActive, highActive, lowActive)
-	fmt.Fprintf(w, "Finished (in-cache): %v\n\n", cached)
-	fmt.Fprintf(w, "Finished (total): %v", finished)
+	for _, param := range historyParams {
+		if _, ok := r.URL.Query()[param]; ok {
+			JobsHistory(ctx, w, r)
+			return
+		}
+	}
+
+	stats, err := Qmd.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
+
+	total := func(counts map[string]int) int {
+		n := 0
+		for _, c := range counts {
+			n += c
+		}
+		return n
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "Queued: %v\n- %v (urgent)\n- %v (high)\n- %v (low)\n\n", total(stats.Queued), stats.Queued["urgent"], stats.Queued["high"], stats.Queued["low"])
+	fmt.Fprintf(w, "Running: %v\n- %v (urgent)\n- %v (high)\n- %v (low)\n\n", total(stats.Running), stats.Running["urgent"], stats.Running["high"], stats.Running["low"])
+	fmt.Fprintf(w, "Finished (in-cache): %v\n\n", stats.Cached)
+	fmt.Fprintf(w, "Finished (total): %v", stats.Total)
+}
+
+// JobsHistory lists the finished jobs, newest first.
+func JobsHistory(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	q := &qmd.JobsQuery{
+		Script: params.Get("script"),
+		Status: strings.ToUpper(params.Get("status")),
+		Limit:  defaultHistoryLimit,
+		Cursor: params.Get("cursor"),
+	}
+
+	var err error
+	if q.Since, err = parseTime(params.Get("since")); err != nil {
+		http.Error(w, "since: "+err.Error(), 422)
+		return
+	}
+	if q.Until, err = parseTime(params.Get("until")); err != nil {
+		http.Error(w, "until: "+err.Error(), 422)
+		return
+	}
+	if limit := params.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit < 1 || q.Limit > maxHistoryLimit {
+			http.Error(w, "limit: must be a number between 1 and "+strconv.Itoa(maxHistoryLimit), 422)
+			return
+		}
+	}
+
+	resps, next, err := Qmd.DB.ListResponses(q)
+	if err != nil {
+		if err == qmd.ErrInvalidCursor {
+			http.Error(w, "cursor: "+err.Error(), 422)
+			return
+		}
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if resps == nil {
+		resps = []*api.ScriptsResponse{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&api.JobsList{Jobs: resps, NextCursor: next})
+}
+
+// parseTime parses RFC 3339 time, or duration (e.g. "1h") before now.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("expected RFC 3339 time or duration, e.g. 1h")
+	}
+	return t, nil
+}
+
+func Metrics(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := Qmd.WriteMetrics(w); err != nil {
+		lg.Errorf("Handler:\tcan't write metrics: %v", err)
+	}
 }
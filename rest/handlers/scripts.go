@@ -1,38 +1,100 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/goware/lg"
 	"github.com/goware/urlx"
 	"golang.org/x/net/context"
 
 	"github.com/pressly/chi"
+	"github.com/pressly/qmd"
 	"github.com/pressly/qmd/rest/api"
 )
 
 func CreateJob(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	// Low, high and urgent priorities only (high is default).
+	// Low, high and urgent priorities only (high is default,
+	// unless the script's manifest says otherwise).
 	priority := r.URL.Query().Get("priority")
 	switch priority {
-	case "low", "high", "urgent":
+	case "low", "high", "urgent", "":
 		// NOP.
-	case "":
-		priority = "high"
 	default:
 		http.Error(w, "unknown priority \""+priority+"\"", 422)
 		return
 	}
 
-	// Decode request data.
-	var req *api.ScriptsRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	// Decode request data, and stage the uploaded files until the job
+	// runs. The staged files are removed, unless the job is enqueued.
+	staging, err := Qmd.NewStaging()
 	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	enqueued := false
+	defer func() {
+		if !enqueued {
+			staging.Remove()
+		}
+	}()
+
+	req, err := decodeRequest(r, staging)
+	if err != nil {
+		if _, ok := err.(*qmd.FileTooLargeError); ok {
+			http.Error(w, err.Error(), 413)
+			return
+		}
 		http.Error(w, "parse request body: "+err.Error(), 422)
 		return
 	}
 	req.Script = chi.URLParams(ctx)["filename"]
+	req.CreatedBy = ""
+	if token, ok := ctx.Value("token").(*qmd.Token); ok {
+		req.CreatedBy = token.Name
+	}
+
+	// Validate the request against the script's manifest.
+	manifest, err := Qmd.Scripts.Manifest(req.Script)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if manifest != nil {
+		if err := manifest.Validate(req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), 422)
+			return
+		}
+		if priority == "" {
+			priority = manifest.Priority
+		}
+	} else if len(req.Env) > 0 {
+		http.Error(w, "invalid request: env is not allowed", 422)
+		return
+	}
+	if priority == "" {
+		priority = "high"
+	}
+
+	// Make sure the job can run as its user.
+	if _, err := Qmd.Credential(req.Script); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), 422)
+		return
+	}
+
+	// Fix the timeout, so the worker and the queue agree on it.
+	timeout, err := Qmd.Timeout(req.Script, req.Timeout)
+	if err != nil {
+		http.Error(w, "invalid request: "+err.Error(), 422)
+		return
+	}
+	req.Timeout = int(timeout / time.Second)
 
 	// Make sure ASYNC callback is valid URL.
 	if req.CallbackURL != "" {
@@ -51,25 +113,18 @@ func CreateJob(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	lg.Debugf("Handler:\tEnqueue \"%v\" request", priority)
-	job, err := Qmd.Enqueue(string(data), priority)
+	job, err := Qmd.Enqueue(string(data), priority, timeout)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	enqueued = true
 
 	// Async.
 	if req.CallbackURL != "" {
-		resp, _ := Qmd.GetAsyncResponse(req, job.ID)
+		resp, _ := Qmd.GetAsyncResponse(req, job.ID, priority)
 		w.Write(resp)
 		lg.Debugf("Handler:\tResponded with job %s ASYNC result", job.ID)
-
-		go func() {
-			//TODO: Retry callback if it failed?
-			err := Qmd.PostResponseCallback(req, job.ID)
-			if err != nil {
-				lg.Errorf("can't post callback to %v", err)
-			}
-		}()
 		return
 	}
 
@@ -94,3 +149,144 @@ func CreateJob(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	// 		}
 	// 	}()
 }
+
+// decodeRequest decodes JSON or multipart/form-data request. The multipart
+// request has the JSON encoded request in the "request" field and the files
+// in the file fields. Files of the multipart request and the base64 encoded
+// files are streamed to the staging.
+func decodeRequest(r *http.Request, staging *qmd.Staging) (*api.ScriptsRequest, error) {
+	var req *api.ScriptsRequest
+
+	// The JSON encoded request may carry the files, base64 encoded files
+	// take 4/3 of their size.
+	var maxRequest int64
+	if max := Qmd.Config.Files.MaxTotalSize; max > 0 {
+		maxRequest = int64(max)<<20/3*4 + 1<<20
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case part.FileName() != "":
+				err = staging.Add(part.FileName(), part)
+			case part.FormName() == "request":
+				err = json.NewDecoder(limitRequest(part, maxRequest)).Decode(&req)
+			default:
+				err = fmt.Errorf("unexpected field \"%v\"", part.FormName())
+			}
+			part.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if err := json.NewDecoder(limitRequest(r.Body, maxRequest)).Decode(&req); err != nil {
+			return nil, err
+		}
+	}
+	if req == nil {
+		req = &api.ScriptsRequest{}
+	}
+
+	for name, data := range req.FilesBase64 {
+		if err := staging.Add(name, base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))); err != nil {
+			return nil, err
+		}
+	}
+	req.FilesBase64 = nil
+	if err := staging.AddInline(req.Files); err != nil {
+		return nil, err
+	}
+	stdin, err := qmd.Stdin(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := staging.AddStdin(stdin); err != nil {
+		return nil, err
+	}
+
+	req.Uploads = nil
+	req.Staging = ""
+	if len(staging.Files) > 0 {
+		req.Uploads = staging.Files
+		req.Staging = staging.ID
+	}
+	return req, nil
+}
+
+// limitRequest returns reader of the JSON encoded request, which fails
+// with FileTooLargeError after max bytes; zero means no limit.
+func limitRequest(r io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &requestReader{r: r, n: max, max: max}
+}
+
+type requestReader struct {
+	r   io.Reader
+	n   int64 // Bytes left.
+	max int64
+}
+
+func (r *requestReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		// Fail only if there's more.
+		n, err := r.r.Read(make([]byte, 1))
+		if n > 0 {
+			return 0, &qmd.FileTooLargeError{Name: "request", Max: r.max, Total: true}
+		}
+		return 0, err
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+func Scripts(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	list, err := Qmd.Scripts.List()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// List only the scripts the token can run.
+	if token, ok := ctx.Value("token").(*qmd.Token); ok {
+		allowed := list[:0]
+		for _, info := range list {
+			if token.CanRun(info.Name) {
+				allowed = append(allowed, info)
+			}
+		}
+		list = allowed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func Script(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	info, err := Qmd.Scripts.Info(chi.URLParams(ctx)["filename"])
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
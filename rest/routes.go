@@ -27,11 +27,18 @@ func Routes(qmd *qmd.Qmd) http.Handler {
 
 	r.Get("/", handlers.Index)
 	r.Get("/ping", handlers.Ping)
-
-	r.Post("/scripts/:filename", handlers.CreateJob)
-
-	r.Get("/jobs", handlers.Jobs)
-	r.Get("/jobs/*", GetLongID, handlers.Job)
+	r.Get("/metrics", Authenticate, JobsAccess, handlers.Metrics)
+
+	r.Get("/scripts", Authenticate, handlers.Scripts)
+	r.Get("/scripts/:filename", Authenticate, ScriptAccess, handlers.Script)
+	r.Post("/scripts/:filename", Authenticate, ScriptAccess, handlers.CreateJob)
+
+	r.Get("/jobs", Authenticate, JobsAccess, handlers.Jobs)
+	r.Get("/jobs/:id/log", Authenticate, JobsAccess, handlers.JobLog)
+	r.Get("/jobs/:id/artifacts", Authenticate, JobsAccess, handlers.JobArtifacts)
+	r.Get("/jobs/:id/artifacts/:name", Authenticate, JobsAccess, handlers.JobArtifact)
+	r.Get("/jobs/*", Authenticate, JobsAccess, GetLongID, handlers.Job)
+	r.Delete("/jobs/:id", Authenticate, JobsAccess, handlers.CancelJob)
 
 	return r
 }
@@ -1,26 +1,108 @@
 package rest_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pressly/qmd"
 	"github.com/pressly/qmd/config"
 	"github.com/pressly/qmd/rest"
+	"github.com/pressly/qmd/rest/api"
 )
 
-func TestPing(t *testing.T) {
-	conf, _ := config.New("../etc/qmd.conf.sample")
+// newTestQmd runs QMD with in-memory queue and file store,
+// so the tests don't need Disque or Redis.
+func newTestQmd(t *testing.T, configure ...func(conf *config.Config)) (*qmd.Qmd, func()) {
+	conf, err := config.New("../etc/qmd.conf.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	qmd := &qmd.Qmd{
-		Config:             conf,
-		DB:                 nil,
-		Queue:              nil,
-		ClosingListenQueue: make(chan struct{}),
-		ClosingWorkers:     make(chan struct{}),
+	tmp, err := ioutil.TempDir("", "qmd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf.ScriptDir, err = filepath.Abs("../examples/scripts")
+	if err != nil {
+		t.Fatal(err)
 	}
+	conf.WorkDir = tmp
+	conf.StoreDir = tmp
+	conf.MaxJobs = 2
+	conf.Queue.Backend = "memory"
+	conf.DB.Backend = "file"
+	conf.DB.Dir = tmp + "/db"
+	conf.Callback.Backoff = 1
+	for _, fn := range configure {
+		fn(conf)
+	}
+
+	app, err := qmd.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Scripts.Update(conf.ScriptDir); err != nil {
+		t.Fatal(err)
+	}
+	go app.StartWorkers()
+	go app.ListenQueue()
+	go app.DispatchCallbacks()
+
+	return app, func() {
+		app.Close()
+		os.RemoveAll(tmp)
+	}
+}
+
+// newTestServer serves Qmd running the scripts in files, see newTestQmd.
+// The files map the file names to their content; the .sh files are
+// executable.
+func newTestServer(t *testing.T, files map[string]string, configure ...func(conf *config.Config)) (*qmd.Qmd, *httptest.Server, func()) {
+	scripts, err := ioutil.TempDir("", "qmd-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		perm := os.FileMode(0644)
+		if strings.HasSuffix(name, ".sh") {
+			perm = 0755
+		}
+		if err := ioutil.WriteFile(filepath.Join(scripts, name), []byte(data), perm); err != nil {
+			os.RemoveAll(scripts)
+			t.Fatal(err)
+		}
+	}
+
+	configure = append([]func(conf *config.Config){func(conf *config.Config) {
+		conf.ScriptDir = scripts
+	}}, configure...)
+	app, cleanup := newTestQmd(t, configure...)
+	ts := httptest.NewServer(rest.Routes(app))
+
+	return app, ts, func() {
+		ts.Close()
+		cleanup()
+		os.RemoveAll(scripts)
+	}
+}
+
+func TestPing(t *testing.T) {
+	qmd, cleanup := newTestQmd(t)
+	defer cleanup()
 
 	ts := httptest.NewServer(rest.Routes(qmd))
 	defer ts.Close()
@@ -44,3 +126,1018 @@ func TestPing(t *testing.T) {
 		t.Error("unexpected response body")
 	}
 }
+
+func TestCreateJob(t *testing.T) {
+	qmd, cleanup := newTestQmd(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/scripts/echo.sh", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		t.Fatalf("unexpected response status code %v", res.StatusCode)
+	}
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "OK" {
+		t.Errorf(`expected "OK", got "%s": %s`, resp.Status, resp.Err)
+	}
+	if !strings.Contains(resp.ExecLog, "Running date") {
+		t.Errorf(`unexpected exec_log "%s"`, resp.ExecLog)
+	}
+
+	// The response is stored.
+	res, err = http.Get(ts.URL + "/jobs/" + resp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		t.Errorf("unexpected response status code %v", res.StatusCode)
+	}
+}
+
+func TestCreateJobValidation(t *testing.T) {
+	qmd, cleanup := newTestQmd(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	tt := []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/scripts/sleep.sh", `{"args": ["1; rm -rf /"]}`, 422},
+		{"/scripts/sleep.sh", `{"args": ["1", "2"]}`, 422},
+		{"/scripts/sleep.sh", `{"args": ["1"], "env": {"FOO": "bar"}}`, 422},
+		{"/scripts/echo.sh", `{"env": {"FOO": "bar"}}`, 422},
+		{"/scripts/sleep.sh?priority=asap", `{"args": ["1"]}`, 422},
+		{"/scripts/unknown.sh", `{}`, 404},
+	}
+	for _, tc := range tt {
+		res, err := http.Post(ts.URL+tc.path, "application/json", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tc.status {
+			t.Errorf("%v %v: expected %v, got %v", tc.path, tc.body, tc.status, res.StatusCode)
+		}
+	}
+
+	if n, _ := qmd.Queue.Len("low"); n != 0 {
+		t.Errorf("expected no queued jobs, got %v", n)
+	}
+}
+
+func TestScripts(t *testing.T) {
+	app, cleanup := newTestQmd(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(app))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var list []*qmd.ScriptInfo
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("expected 3 scripts, got %v", len(list))
+	}
+	if list[0].Name != "echo.sh" || list[0].Size == 0 || list[0].SHA256 == "" || list[0].Manifest != nil {
+		t.Errorf("unexpected echo.sh details %+v", list[0])
+	}
+	if list[2].Name != "sleep.sh" || list[2].Manifest == nil || list[2].Manifest.Priority != "low" {
+		t.Errorf("unexpected sleep.sh details %+v", list[2])
+	}
+
+	res, err = http.Get(ts.URL + "/scripts/sleep.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var info *qmd.ScriptInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.SHA256 != list[2].SHA256 {
+		t.Errorf(`expected "%v", got "%v"`, list[2].SHA256, info.SHA256)
+	}
+
+	res, err = http.Get(ts.URL + "/scripts/unknown.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 404 {
+		t.Errorf("unexpected response status code %v", res.StatusCode)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	qmd, cleanup := newTestQmd(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/scripts/echo.sh", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	res, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	metrics, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []string{
+		`qmd_queue_jobs{priority="urgent",state="queued"} 0`,
+		`qmd_workers{state="busy"} 0`,
+		`qmd_workers{state="idle"} 2`,
+		`qmd_jobs_total{script="echo.sh",status="ok"} 1`,
+		`qmd_job_duration_seconds_bucket{script="echo.sh",le="+Inf"} 1`,
+		`qmd_job_duration_seconds_count{script="echo.sh"} 1`,
+		`qmd_callbacks_total{outcome="delivered"} 0`,
+		`qmd_slack_notify_failures_total 0`,
+	} {
+		if !strings.Contains(string(metrics), e+"\n") {
+			t.Errorf("expected %q in:\n%s", e, metrics)
+		}
+	}
+}
+
+func TestJobsStats(t *testing.T) {
+	qmd, cleanup := newTestQmd(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/scripts/echo.sh", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	res, err = http.Post(ts.URL+"/scripts/sleep.sh", "application/json", strings.NewReader(`{"args": ["30"], "callback_url": "http://localhost:1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	defer qmd.Cancel(resp.ID)
+
+	// Let the worker start the job.
+	time.Sleep(100 * time.Millisecond)
+
+	req, _ := http.NewRequest("GET", ts.URL+"/jobs", nil)
+	req.Header.Set("Accept", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+
+	var stats api.JobsStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Finished["high"] != 1 || stats.Total != 1 {
+		t.Errorf("expected 1 finished high priority job, got %v", stats.Finished)
+	}
+	if stats.Running["low"] != 1 {
+		t.Errorf("expected 1 running low priority job, got %v", stats.Running)
+	}
+	if stats.Node.Workers["busy"] != 1 {
+		t.Errorf("expected 1 busy worker, got %v", stats.Node.Workers)
+	}
+	if s := stats.Node.Scripts["echo.sh"]; s == nil || s.Finished != 1 {
+		t.Errorf("expected 1 finished echo.sh job, got %+v", s)
+	}
+	if s := stats.Node.Scripts["sleep.sh"]; s == nil || s.Running != 1 {
+		t.Errorf("expected 1 running sleep.sh job, got %+v", s)
+	}
+	if len(stats.Node.RunningJobs) != 1 || stats.Node.RunningJobs[0].ID != resp.ID || stats.Node.RunningJobs[0].StartTime.IsZero() {
+		t.Errorf("unexpected running jobs %+v", stats.Node.RunningJobs)
+	}
+
+	// Plain text by default.
+	res, err = http.Get(ts.URL + "/jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+}
+
+func TestJobsHistory(t *testing.T) {
+	qmd, cleanup := newTestQmd(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	var IDs []string
+	for i := 0; i < 3; i++ {
+		res, err := http.Post(ts.URL+"/scripts/echo.sh", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp api.ScriptsResponse
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		IDs = append(IDs, resp.ID)
+	}
+
+	list := func(query string) *api.JobsList {
+		res, err := http.Get(ts.URL + "/jobs?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != 200 {
+			t.Fatalf("%v: unexpected response status code %v", query, res.StatusCode)
+		}
+		var list api.JobsList
+		if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		return &list
+	}
+
+	// Newest first, paginated.
+	page := list("script=echo.sh&status=ok&since=1h&limit=2")
+	if len(page.Jobs) != 2 || page.Jobs[0].ID != IDs[2] || page.Jobs[1].ID != IDs[1] || page.NextCursor == "" {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	if page.Jobs[0].ExecLog != "" {
+		t.Error("expected exec_log to be stripped")
+	}
+	page = list("script=echo.sh&status=ok&since=1h&limit=2&cursor=" + page.NextCursor)
+	if len(page.Jobs) != 1 || page.Jobs[0].ID != IDs[0] || page.NextCursor != "" {
+		t.Errorf("unexpected last page %+v", page)
+	}
+
+	if page := list("status=err"); len(page.Jobs) != 0 {
+		t.Errorf("expected no failed jobs, got %+v", page.Jobs)
+	}
+	if page := list("until=1h"); len(page.Jobs) != 0 {
+		t.Errorf("expected no jobs older than 1h, got %+v", page.Jobs)
+	}
+
+	res, err := http.Get(ts.URL + "/jobs?cursor=foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 422 {
+		t.Errorf("unexpected response status code %v for invalid cursor", res.StatusCode)
+	}
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	qmd, cleanup := newTestQmd(t, func(conf *config.Config) {
+		conf.Limits = []config.LimitConfig{{Script: "sleep*.sh", MaxJobs: 1}}
+	})
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer callback.Close()
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Post(ts.URL+"/scripts/sleep.sh", "application/json", strings.NewReader(`{"args": ["30"], "callback_url": "`+callback.URL+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp api.ScriptsResponse
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		defer qmd.Cancel(resp.ID)
+	}
+
+	// Let the worker start the first job.
+	time.Sleep(100 * time.Millisecond)
+
+	// The other worker isn't blocked by the second sleep.sh job.
+	start := time.Now()
+	res, err := http.Post(ts.URL+"/scripts/echo.sh", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "OK" {
+		t.Errorf(`expected "OK", got "%s": %s`, resp.Status, resp.Err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("echo.sh job waited for %v", time.Since(start))
+	}
+
+	stats, err := qmd.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Running["low"] != 1 || stats.Queued["low"] != 1 {
+		t.Errorf("expected 1 running and 1 queued sleep.sh job, got %v running, %v queued", stats.Running, stats.Queued)
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	qmd, cleanup := newTestQmd(t, func(conf *config.Config) {
+		conf.MaxTimeout = 10
+	})
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/scripts/sleep.sh", "application/json", strings.NewReader(`{"args": ["5"], "timeout": 11}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 422 {
+		t.Errorf("expected 422 for timeout over max_timeout, got %v", res.StatusCode)
+	}
+
+	start := time.Now()
+	res, err = http.Post(ts.URL+"/scripts/sleep.sh", "application/json", strings.NewReader(`{"args": ["5"], "timeout": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "ERR" || resp.Timeout != 1 {
+		t.Errorf(`expected "ERR" after 1s timeout, got "%s" after %vs timeout`, resp.Status, resp.Timeout)
+	}
+	if !resp.TimedOut || resp.Signal != "SIGTERM" {
+		t.Errorf("expected the job to time out and get SIGTERM, got timed_out=%v, signal=%q", resp.TimedOut, resp.Signal)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Errorf("job wasn't killed after 1s, took %v", time.Since(start))
+	}
+
+	// The script's timeout (60s) is capped by max_timeout.
+	timeout, err := qmd.Timeout("sleep.sh", 0)
+	if err != nil || timeout != 10*time.Second {
+		t.Errorf("expected 10s timeout, got %v (%v)", timeout, err)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	qmd, cleanup := newTestQmd(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer callback.Close()
+
+	res, err := http.Post(ts.URL+"/scripts/sleep.sh", "application/json", strings.NewReader(`{"args": ["30"], "callback_url": "`+callback.URL+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "QUEUED" {
+		t.Fatalf(`expected "QUEUED", got "%s"`, resp.Status)
+	}
+
+	// Let the worker start the job.
+	time.Sleep(100 * time.Millisecond)
+
+	req, _ := http.NewRequest("DELETE", ts.URL+"/jobs/"+resp.ID, nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		t.Fatalf("unexpected response status code %v", res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "CANCELLED" || !resp.Cancelled {
+		t.Errorf(`expected "CANCELLED", got "%s"`, resp.Status)
+	}
+
+	// Job can't be cancelled twice.
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 409 {
+		t.Errorf("unexpected response status code %v", res.StatusCode)
+	}
+}
+
+func TestCancelJobFromAnotherNode(t *testing.T) {
+	app, cleanup := newTestQmd(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(app))
+	defer ts.Close()
+
+	callbacks := make(chan api.ScriptsResponse, 10)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp api.ScriptsResponse
+		json.NewDecoder(r.Body).Decode(&resp)
+		callbacks <- resp
+	}))
+	defer callback.Close()
+
+	res, err := http.Post(ts.URL+"/scripts/sleep.sh", "application/json", strings.NewReader(`{"args": ["30"], "callback_url": "`+callback.URL+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Let the worker start the job.
+	time.Sleep(100 * time.Millisecond)
+
+	// Another node shares the store and the queue, but not the running jobs.
+	other := &qmd.Qmd{Config: app.Config, DB: app.DB, Queue: app.Queue}
+	if err := other.Cancel(resp.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case resp = <-callbacks:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback wasn't delivered")
+	}
+	if resp.Status != "CANCELLED" || !resp.Cancelled {
+		t.Errorf(`expected "CANCELLED", got "%s"`, resp.Status)
+	}
+
+	// The worker kills the job, but its response doesn't replace
+	// the one saved by Cancel().
+	for i := 0; i < 50 && app.BusyWorkers() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if busy := app.BusyWorkers(); busy > 0 {
+		t.Fatalf("job is still running on %v workers", busy)
+	}
+	select {
+	case resp := <-callbacks:
+		t.Errorf("unexpected second callback %+v", resp)
+	case <-time.After(1500 * time.Millisecond):
+	}
+	if err := app.DB.SaveResponse(&resp); err != qmd.ErrJobFinished {
+		t.Errorf("expected ErrJobFinished, got %v", err)
+	}
+}
+
+func TestJobLog(t *testing.T) {
+	qmd, cleanup := newTestQmd(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer callback.Close()
+
+	res, err := http.Post(ts.URL+"/scripts/sleep.sh", "application/json", strings.NewReader(`{"args": ["1"], "callback_url": "`+callback.URL+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = http.Get(ts.URL + "/jobs/" + resp.ID + "/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		t.Fatalf("unexpected response status code %v", res.StatusCode)
+	}
+
+	// The stream ends when the job finishes.
+	log, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := "Sleeping for 1 seconds.\nDone.\n"; string(log) != e {
+		t.Errorf(`expected "%s", got "%s"`, e, log)
+	}
+
+	res, err = http.Get(ts.URL + "/jobs/unknown/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 404 {
+		t.Errorf("unexpected response status code %v", res.StatusCode)
+	}
+}
+
+func TestCallbackRetry(t *testing.T) {
+	qmd, cleanup := newTestQmd(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	// Fail the first delivery.
+	attempts := 0
+	delivered := make(chan api.ScriptsResponse, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "unavailable", 503)
+			return
+		}
+		var resp api.ScriptsResponse
+		json.NewDecoder(r.Body).Decode(&resp)
+		delivered <- resp
+	}))
+	defer callback.Close()
+
+	res, err := http.Post(ts.URL+"/scripts/echo.sh", "application/json", strings.NewReader(`{"callback_url": "`+callback.URL+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case resp = <-delivered:
+	case <-time.After(10 * time.Second):
+		t.Fatal("callback wasn't delivered")
+	}
+	if resp.Status != "OK" {
+		t.Errorf(`expected "OK", got "%s"`, resp.Status)
+	}
+	if resp.Callback == nil || len(resp.Callback.Attempts) != 1 || resp.Callback.Attempts[0].StatusCode != 503 {
+		t.Errorf("expected the failed attempt to be recorded, got %+v", resp.Callback)
+	}
+
+	// Wait for the successful attempt to be recorded.
+	for i := 0; i < 20; i++ {
+		data, err := qmd.DB.GetResponse(resp.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal(data, &resp)
+		if resp.Callback.Status == "DELIVERED" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if resp.Callback.Status != "DELIVERED" || len(resp.Callback.Attempts) != 2 {
+		t.Errorf("unexpected callback status %+v", resp.Callback)
+	}
+}
+
+func TestCallbackInvalidURL(t *testing.T) {
+	app, cleanup := newTestQmd(t, func(conf *config.Config) {
+		conf.Callback.MaxAttempts = 1
+	})
+	defer cleanup()
+
+	// The request can't be created for the URL.
+	resp := &api.ScriptsResponse{ID: "badurl", Script: "echo.sh", Status: "OK", EndTime: time.Now()}
+	if err := app.SaveResponse(resp, "http://localhost/\x7f"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 40; i++ {
+		data, err := app.DB.GetResponse(resp.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal(data, resp)
+		if resp.Callback != nil && resp.Callback.Status == "FAILED" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if resp.Callback == nil || resp.Callback.Status != "FAILED" || len(resp.Callback.Attempts) != 1 || resp.Callback.Attempts[0].Err == "" {
+		t.Errorf("expected the failed attempt to be recorded, got %+v", resp.Callback)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	qmd, cleanup := newTestQmd(t, func(conf *config.Config) {
+		conf.Auth.Enabled = true
+		conf.Auth.Tokens = []config.TokenConfig{
+			{Name: "ci", Token: "ci-secret", Scripts: []string{"ech*.sh"}},
+		}
+	})
+	defer cleanup()
+
+	ts := httptest.NewServer(rest.Routes(qmd))
+	defer ts.Close()
+
+	tt := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"GET", "/ping", "", 200},
+		{"POST", "/scripts/echo.sh", "", 401},
+		{"POST", "/scripts/echo.sh", "wrong", 401},
+		{"POST", "/scripts/sleep.sh", "ci-secret", 403},
+		{"GET", "/jobs", "ci-secret", 403},
+		{"POST", "/scripts/echo.sh", "ci-secret", 200},
+	}
+	for _, tc := range tt {
+		req, _ := http.NewRequest(tc.method, ts.URL+tc.path, strings.NewReader(`{"created_by": "someone"}`))
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != tc.status {
+			t.Errorf("%v %v: expected %v, got %v", tc.method, tc.path, tc.status, res.StatusCode)
+			continue
+		}
+
+		if tc.method == "POST" && res.StatusCode == 200 {
+			var resp api.ScriptsResponse
+			if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.CreatedBy != "ci" {
+				t.Errorf(`expected "ci", got "%s"`, resp.CreatedBy)
+			}
+		}
+	}
+}
+
+func TestJobArtifacts(t *testing.T) {
+	script := `#!/bin/bash
+mkdir -p $QMD_TMP/artifacts $QMD_TMP/reports
+echo -n '{"ok":true}' >$QMD_TMP/artifacts/result.json
+echo -n report >$QMD_TMP/reports/report.txt
+echo -n scratch >$QMD_TMP/scratch.txt
+ln -s /etc/passwd $QMD_TMP/artifacts/passwd
+`
+	app, ts, cleanup := newTestServer(t, map[string]string{
+		"build.sh":      script,
+		"build.sh.toml": `artifacts = ["reports/*.txt"]`,
+	})
+	defer cleanup()
+
+	// The artifacts are kept in QMD's private dir.
+	info, err := os.Stat(app.Config.StoreDir + "/qmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("expected private dir mode 0700, got %o", perm)
+	}
+
+	res, err := http.Post(ts.URL+"/scripts/build.sh", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "OK" {
+		t.Fatalf(`expected "OK", got "%s": %s`, resp.Status, resp.ExecLog)
+	}
+
+	// Only the artifacts, no symlinks.
+	expected := []api.Artifact{{Name: "report.txt", Size: 6}, {Name: "result.json", Size: 11}}
+	if len(resp.Artifacts) != 2 || resp.Artifacts[0] != expected[0] || resp.Artifacts[1] != expected[1] {
+		t.Errorf("expected artifacts %v, got %v", expected, resp.Artifacts)
+	}
+
+	res, err = http.Get(ts.URL + "/jobs/" + resp.ID + "/artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var list []api.Artifact
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0] != expected[0] || list[1] != expected[1] {
+		t.Errorf("expected artifacts %v, got %v", expected, list)
+	}
+
+	res, err = http.Get(ts.URL + "/jobs/" + resp.ID + "/artifacts/result.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	data, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(data) != `{"ok":true}` {
+		t.Errorf("unexpected artifact %v %q", res.StatusCode, data)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf(`expected "application/json", got %q`, ct)
+	}
+
+	for _, path := range []string{"/artifacts/passwd", "/artifacts/scratch.txt", "/artifacts/..", "/artifacts"} {
+		id := resp.ID
+		if path == "/artifacts" {
+			id = "unknown"
+		}
+		res, err = http.Get(ts.URL + "/jobs/" + id + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 404 {
+			t.Errorf("%v: expected 404, got %v", path, res.StatusCode)
+		}
+	}
+}
+
+func TestJobArtifactsDisabled(t *testing.T) {
+	_, ts, cleanup := newTestServer(t, map[string]string{
+		"build.sh": "#!/bin/bash\nmkdir -p $QMD_TMP/artifacts && echo -n ok >$QMD_TMP/artifacts/result.txt\n",
+	}, func(conf *config.Config) {
+		conf.StoreDir = ""
+		conf.Artifacts.Dir = ""
+	})
+	defer cleanup()
+
+	res, err := http.Post(ts.URL+"/scripts/build.sh", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "OK" {
+		t.Fatalf(`expected "OK", got "%s": %s`, resp.Status, resp.ExecLog)
+	}
+	if len(resp.Artifacts) != 0 {
+		t.Errorf("expected no artifacts, got %v", resp.Artifacts)
+	}
+
+	for _, path := range []string{"/artifacts", "/artifacts/result.txt"} {
+		res, err = http.Get(ts.URL + "/jobs/" + resp.ID + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 404 {
+			t.Errorf("%v: expected 404, got %v", path, res.StatusCode)
+		}
+	}
+}
+
+func TestFileUploads(t *testing.T) {
+	var stagingDir string
+	_, ts, cleanup := newTestServer(t, map[string]string{
+		"sum.sh": "#!/bin/bash\ncd $QMD_TMP && sha256sum $@ | cut -c1-64\n",
+	}, func(conf *config.Config) {
+		conf.Files.MaxFileSize = 1
+		conf.Files.MaxTotalSize = 1
+		stagingDir = conf.StoreDir + "/staging"
+		conf.Files.StagingDir = stagingDir
+	})
+	defer cleanup()
+
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+	sum := sha256.Sum256(binary)
+	expected := hex.EncodeToString(sum[:]) + "\n"
+
+	// Base64 encoded file.
+	body, _ := json.Marshal(api.ScriptsRequest{
+		Args:        []string{"blob.bin"},
+		FilesBase64: map[string]string{"blob.bin": base64.StdEncoding.EncodeToString(binary)},
+	})
+	res, err := http.Post(ts.URL+"/scripts/sum.sh", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp api.ScriptsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ExecLog != expected || len(resp.Uploads) != 1 || resp.Uploads[0] != "blob.bin" {
+		t.Errorf("unexpected response %q %v", resp.ExecLog, resp.Uploads)
+	}
+
+	// Multipart request.
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormField("request")
+	fw.Write([]byte(`{"args": ["image.bin"]}`))
+	fw, _ = mw.CreateFormFile("file", "image.bin")
+	fw.Write(binary)
+	mw.Close()
+
+	res, err = http.Post(ts.URL+"/scripts/sum.sh", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resp = api.ScriptsResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ExecLog != expected {
+		t.Errorf("expected %q, got %q", expected, resp.ExecLog)
+	}
+
+	// Files over the limit.
+	buf.Reset()
+	mw = multipart.NewWriter(&buf)
+	fw, _ = mw.CreateFormFile("file", "big.bin")
+	fw.Write(make([]byte, 1<<20+1))
+	mw.Close()
+
+	res, err = http.Post(ts.URL+"/scripts/sum.sh", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 413 {
+		t.Errorf("expected 413, got %v", res.StatusCode)
+	}
+
+	// Reserved file names.
+	for _, name := range []string{"QMD_OUT", "artifacts"} {
+		buf.Reset()
+		mw = multipart.NewWriter(&buf)
+		fw, _ = mw.CreateFormFile("file", name)
+		fw.Write([]byte("data"))
+		mw.Close()
+
+		res, err = http.Post(ts.URL+"/scripts/sum.sh", mw.FormDataContentType(), &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 422 {
+			t.Errorf("%v: expected 422, got %v", name, res.StatusCode)
+		}
+	}
+
+	// Requests over the limit, with inline files.
+	big := `{"files": {"big.txt": "` + strings.Repeat("x", 3<<20) + `"}}`
+	buf.Reset()
+	mw = multipart.NewWriter(&buf)
+	fw, _ = mw.CreateFormField("request")
+	fw.Write([]byte(big))
+	mw.Close()
+
+	for _, ct := range []string{"application/json", mw.FormDataContentType()} {
+		body := io.Reader(strings.NewReader(big))
+		if ct != "application/json" {
+			body = &buf
+		}
+		res, err = http.Post(ts.URL+"/scripts/sum.sh", ct, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 413 {
+			t.Errorf("%v: expected 413, got %v", ct, res.StatusCode)
+		}
+	}
+
+	// No staged files are left behind.
+	if infos, _ := ioutil.ReadDir(stagingDir); len(infos) != 0 {
+		t.Errorf("expected empty staging dir, got %v files", len(infos))
+	}
+}
+
+func TestStdin(t *testing.T) {
+	_, ts, cleanup := newTestServer(t, map[string]string{
+		"upper.sh": "#!/bin/bash\ntr a-z A-Z\n",
+	})
+	defer cleanup()
+
+	tt := []struct {
+		body     string
+		status   int
+		expected string
+	}{
+		{`{"stdin": "hello\n"}`, 200, "HELLO\n"},
+		{`{"stdin_base64": "aGVsbG8K"}`, 200, "HELLO\n"},
+		{`{}`, 200, ""},
+		{`{"stdin": "hello", "stdin_base64": "aGVsbG8K"}`, 422, ""},
+		{`{"stdin_base64": "not base64"}`, 422, ""},
+	}
+	for _, tc := range tt {
+		res, err := http.Post(ts.URL+"/scripts/upper.sh", "application/json", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != tc.status {
+			t.Errorf("%v: expected %v, got %v", tc.body, tc.status, res.StatusCode)
+			continue
+		}
+		if tc.status != 200 {
+			continue
+		}
+		var resp api.ScriptsResponse
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ExecLog != tc.expected {
+			t.Errorf("%v: expected %q, got %q", tc.body, tc.expected, resp.ExecLog)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package qmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Credential returns the user and group to run the script's jobs as,
+// from the script's manifest, the matching [[limits]] or the config.
+// It returns nil, if neither run_as_user nor run_as_group is set.
+func (qmd *Qmd) Credential(script string) (*syscall.Credential, error) {
+	var sources [][2]string
+	if m, _ := qmd.Scripts.Manifest(script); m != nil {
+		sources = append(sources, [2]string{m.RunAsUser, m.RunAsGroup})
+	}
+	for _, limit := range qmd.Config.Limits {
+		if ok, _ := path.Match(limit.Script, script); ok {
+			sources = append(sources, [2]string{limit.RunAsUser, limit.RunAsGroup})
+		}
+	}
+	sources = append(sources, [2]string{qmd.Config.RunAsUser, qmd.Config.RunAsGroup})
+
+	var userName, groupName string
+	for _, s := range sources {
+		if userName == "" {
+			userName = s[0]
+		}
+		if groupName == "" {
+			groupName = s[1]
+		}
+	}
+	return lookupCredential(userName, groupName)
+}
+
+// lookupCredential resolves the user and group, given by name or ID.
+// The group defaults to the user's primary group. It returns nil, if
+// both are empty, or an error, if QMD can't switch to them.
+func lookupCredential(userName, groupName string) (*syscall.Credential, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+
+	cred := &syscall.Credential{
+		Uid:    uint32(os.Getuid()),
+		Gid:    uint32(os.Getgid()),
+		Groups: []uint32{},
+	}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, ok := err.(user.UnknownUserError); ok {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("run_as_user: %v", err)
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(u.Gid)
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("run_as_group: %v", err)
+		}
+		gid, _ := strconv.Atoi(g.Gid)
+		cred.Gid = uint32(gid)
+	}
+
+	if os.Geteuid() != 0 && (int(cred.Uid) != os.Geteuid() || int(cred.Gid) != os.Getegid()) {
+		return nil, fmt.Errorf("run_as_user: QMD must run as root to run the jobs as %v:%v", cred.Uid, cred.Gid)
+	}
+	return cred, nil
+}
+
+// chownTree makes the user the owner of the directory and its contents.
+func chownTree(dir string, cred *syscall.Credential) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, int(cred.Uid), int(cred.Gid))
+	})
+}
@@ -0,0 +1,550 @@
+//go:build linux
+// +build linux
+
+package qmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/goware/lg"
+
+	"github.com/pressly/qmd/config"
+)
+
+// probeSandbox checks the sandbox can be used and returns the namespaces
+// available for the jobs. New mount namespace is required, the others
+// are left out with a warning, if the kernel doesn't allow them.
+func probeSandbox(conf *config.SandboxConfig) (uintptr, error) {
+	if os.Geteuid() != 0 {
+		return 0, fmt.Errorf("sandbox: QMD must run as root to set up the sandbox")
+	}
+
+	bin, err := exec.LookPath("true")
+	if err != nil {
+		return 0, fmt.Errorf("sandbox: %v", err)
+	}
+	try := func(flag uintptr) error {
+		cmd := exec.Command(bin)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: flag}
+		return cmd.Run()
+	}
+
+	if err := try(syscall.CLONE_NEWNS); err != nil {
+		return 0, fmt.Errorf("sandbox: can't create mount namespace: %v", err)
+	}
+	flags := uintptr(syscall.CLONE_NEWNS)
+
+	namespaces := []struct {
+		name string
+		flag uintptr
+	}{
+		{"pid", syscall.CLONE_NEWPID},
+		{"ipc", syscall.CLONE_NEWIPC},
+		{"uts", syscall.CLONE_NEWUTS},
+	}
+	if !conf.Network {
+		namespaces = append(namespaces, struct {
+			name string
+			flag uintptr
+		}{"network", syscall.CLONE_NEWNET})
+	}
+	for _, ns := range namespaces {
+		if err := try(ns.flag); err != nil {
+			lg.Warnf("Sandbox:\tcan't create %v namespace: %v", ns.name, err)
+			continue
+		}
+		flags |= ns.flag
+	}
+	return flags, nil
+}
+
+// sandboxEnv is the environment variable passing the sandboxSpec
+// to the re-executed QMD, see runSandbox.
+const sandboxEnv = "QMD_SANDBOX_SPEC"
+
+// sandboxDevices are the host's devices available in the sandbox's /dev.
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+func init() {
+	if spec := os.Getenv(sandboxEnv); spec != "" {
+		runSandbox(spec)
+	}
+}
+
+// sandbox is the mount point of the sandbox's root. It's an empty
+// directory on the host; the root is mounted in the cmd's namespace only.
+type sandbox struct {
+	root string
+
+	// The init of the cmd's PID namespace reports the signal that
+	// ended the cmd to the status pipe, see sandboxSpec.init.
+	status       *os.File
+	statusWriter *os.File
+}
+
+// sandboxSpec describes the sandbox to the re-executed QMD.
+type sandboxSpec struct {
+	Root       string              `json:"root"`
+	Dir        string              `json:"dir"`
+	Binds      []bind              `json:"binds"`
+	Hide       []string            `json:"hide"` // Paths in the binds to hide.
+	Dev        bool                `json:"dev"`  // Whether to set up a minimal /dev.
+	Init       bool                `json:"init"` // Whether to run the cmd under init, see init.
+	StatusFD   int                 `json:"status_fd"`
+	Credential *syscall.Credential `json:"credential"`
+	Path       string              `json:"path"`
+	Args       []string            `json:"args"`
+}
+
+// enterSandbox sets up the cmd to run chrooted in its sandbox, in new
+// namespaces. Only QMD_TMP, QMD_STORE (without QMD's private dir),
+// ScriptDir, the sandbox's read-only paths and a minimal /dev are visible
+// to the cmd.
+//
+// The cmd is run by QMD re-executed in the cmd's namespaces, which sets
+// up the mounts, so they're never visible on the host and they go away
+// with the cmd. See runSandbox.
+func (cmd *Cmd) enterSandbox() error {
+	conf := cmd.Sandbox
+
+	sb := &sandbox{root: filepath.Join(filepath.Dir(cmd.Cmd.Dir), ".sandbox", cmd.JobID)}
+	if err := os.MkdirAll(sb.root, 0755); err != nil {
+		return err
+	}
+	cmd.sandbox = sb
+
+	spec := &sandboxSpec{
+		Root:       sb.root,
+		Dir:        cmd.Cmd.Dir,
+		Dev:        true,
+		Credential: cmd.Cmd.SysProcAttr.Credential,
+		Path:       cmd.Cmd.Path,
+		Args:       cmd.Cmd.Args,
+	}
+	spec.Binds = []bind{
+		{cmd.ScriptDir, true},
+		{cmd.Cmd.Dir, false},
+	}
+	if cmd.StoreDir != "" {
+		spec.Binds = append(spec.Binds, bind{cmd.StoreDir, false})
+		private, err := filepath.Abs(privateDir(cmd.StoreDir))
+		if err != nil {
+			return err
+		}
+		spec.Hide = append(spec.Hide, private)
+	}
+	if cmd.cloneflags&syscall.CLONE_NEWPID != 0 {
+		// The init can't report the signal in its exit status.
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		sb.status, sb.statusWriter = r, w
+		spec.Init = true
+		spec.StatusFD = 3 + len(cmd.Cmd.ExtraFiles)
+		cmd.Cmd.ExtraFiles = append(cmd.Cmd.ExtraFiles, w)
+	}
+	for _, path := range conf.ReadOnly {
+		if filepath.Clean(path) == "/dev" {
+			// Bind the host's /dev instead.
+			spec.Dev = false
+		}
+		spec.Binds = append(spec.Binds, bind{path, true})
+	}
+	// Mount the parents first.
+	sort.Stable(byDepth(spec.Binds))
+
+	// Check the writable paths here, so the cmd fails to start
+	// without them.
+	for i, b := range spec.Binds {
+		path, err := filepath.Abs(b.Path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil && !b.ReadOnly {
+			return fmt.Errorf("sandbox: %v", err)
+		}
+		spec.Binds[i].Path = path
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	cmd.Cmd.Path = "/proc/self/exe"
+	cmd.Cmd.Args = []string{"qmd-sandbox"}
+	cmd.Cmd.Env = append(cmd.Cmd.Env, sandboxEnv+"="+string(data))
+
+	// The re-executed QMD drops the privileges itself.
+	attr := cmd.Cmd.SysProcAttr
+	attr.Credential = nil
+	attr.Cloneflags = cmd.cloneflags | syscall.CLONE_NEWNS
+	return nil
+}
+
+// leaveSandbox removes the cmd's sandbox directory.
+func (cmd *Cmd) leaveSandbox() {
+	sb := cmd.sandbox
+	if sb == nil {
+		return
+	}
+	cmd.sandbox = nil
+
+	if sb.status != nil {
+		sb.status.Close()
+	}
+	if sb.statusWriter != nil {
+		sb.statusWriter.Close()
+	}
+	if err := os.Remove(sb.root); err != nil && !os.IsNotExist(err) {
+		lg.Errorf("Sandbox:\tCan't remove %v: %v", sb.root, err)
+	}
+}
+
+// sandboxSignal returns the signal that ended the cmd, as reported
+// by the init of its PID namespace, if any. The cmd must have finished.
+func (cmd *Cmd) sandboxSignal() syscall.Signal {
+	sb := cmd.sandbox
+	if sb == nil || sb.status == nil {
+		return 0
+	}
+	sb.statusWriter.Close()
+	sb.statusWriter = nil
+
+	var sig int
+	fmt.Fscan(sb.status, &sig)
+	return syscall.Signal(sig)
+}
+
+// runSandbox runs in the re-executed QMD, in the cmd's new namespaces.
+// It sets up the sandbox, drops the privileges and executes the cmd.
+// It never returns.
+func runSandbox(data string) {
+	runtime.LockOSThread()
+
+	var spec sandboxSpec
+	err := json.Unmarshal([]byte(data), &spec)
+	if err == nil {
+		err = spec.setup()
+	}
+	if err == nil {
+		var env []string
+		for _, v := range os.Environ() {
+			if !strings.HasPrefix(v, sandboxEnv+"=") {
+				env = append(env, v)
+			}
+		}
+		if spec.Init {
+			syscall.CloseOnExec(spec.StatusFD)
+			err = spec.init(env)
+		} else {
+			err = syscall.Exec(spec.Path, spec.Args, env)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(126)
+}
+
+func (spec *sandboxSpec) setup() error {
+	// Don't let the mounts propagate to the host, or back.
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", spec.Root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return err
+	}
+
+	for _, b := range spec.Binds {
+		if err := mountBind(spec.Root, b); err != nil {
+			return fmt.Errorf("%v: %v", b.Path, err)
+		}
+	}
+	for _, path := range spec.Hide {
+		// Cover it with an empty read-only tmpfs.
+		target := filepath.Join(spec.Root, path)
+		if _, err := os.Stat(target); err != nil {
+			continue
+		}
+		flags := uintptr(syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+		if err := syscall.Mount("tmpfs", target, "tmpfs", flags, "mode=0,size=4k"); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	if spec.Dev {
+		if err := mountDev(filepath.Join(spec.Root, "dev")); err != nil {
+			return fmt.Errorf("/dev: %v", err)
+		}
+	}
+
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV)
+	if err := syscall.Mount("", spec.Root, "", flags, ""); err != nil {
+		return err
+	}
+	if err := syscall.Chroot(spec.Root); err != nil {
+		return err
+	}
+	if err := syscall.Chdir(spec.Dir); err != nil {
+		return err
+	}
+
+	if c := spec.Credential; c != nil {
+		groups := make([]int, len(c.Groups))
+		for i, gid := range c.Groups {
+			groups[i] = int(gid)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(int(c.Gid)); err != nil {
+			return err
+		}
+		if err := syscall.Setuid(int(c.Uid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initSignals are the signals the init forwards to the cmd.
+var initSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// init runs the cmd as a child of the re-executed QMD, which is the init
+// of the cmd's PID namespace. The kernel drops the signals the init has
+// no handler for, so it forwards them to the cmd's process group, reaps
+// the orphaned processes and exits with the cmd. It returns only if the
+// cmd can't be started.
+func (spec *sandboxSpec) init(env []string) error {
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, initSignals...)
+
+	pid, err := syscall.ForkExec(spec.Path, spec.Args, &syscall.ProcAttr{
+		Env:   env,
+		Files: []uintptr{0, 1, 2},
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	})
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan syscall.WaitStatus, 1)
+	go func() {
+		for {
+			var status syscall.WaitStatus
+			wpid, err := syscall.Wait4(-1, &status, 0, nil)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if wpid == pid {
+				exited <- status
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case sig := <-signals:
+			syscall.Kill(-pid, sig.(syscall.Signal))
+		case status := <-exited:
+			if status.Signaled() {
+				fmt.Fprint(os.NewFile(uintptr(spec.StatusFD), "status"), int(status.Signal()))
+				os.Exit(128 + int(status.Signal()))
+			}
+			// The rest of the namespace is killed with us.
+			os.Exit(status.ExitStatus())
+		}
+	}
+}
+
+type bind struct {
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+type byDepth []bind
+
+func (s byDepth) Len() int      { return len(s) }
+func (s byDepth) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byDepth) Less(i, j int) bool {
+	return strings.Count(filepath.Clean(s[i].Path), "/") < strings.Count(filepath.Clean(s[j].Path), "/")
+}
+
+// mountBind makes the host path visible at the same path in the sandbox.
+// Symlinks are copied, so they resolve within the sandbox.
+func mountBind(root string, b bind) error {
+	info, err := os.Lstat(b.Path)
+	if os.IsNotExist(err) && b.ReadOnly {
+		// Allow generic read-only paths, e.g. /lib64.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(root, b.Path)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(b.Path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(target); err == nil {
+			return nil
+		}
+		return os.Symlink(link, target)
+
+	case info.IsDir():
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+
+	default:
+		if err := createFile(target); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Mount(b.Path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if b.ReadOnly {
+		return remountReadOnly(target)
+	}
+	return nil
+}
+
+// remountReadOnly remounts the bind mount at target read-only, along
+// with all the mounts under it, e.g. /dev/shm of /dev. The other flags
+// of the mounts, e.g. nodev, are kept.
+func remountReadOnly(target string) error {
+	mounts, err := mountsUnder(target)
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		flags := m.flags | syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID
+		if err := syscall.Mount("", m.point, "", flags, ""); err != nil {
+			return fmt.Errorf("%v: %v", m.point, err)
+		}
+	}
+	return nil
+}
+
+// mountDev mounts a minimal /dev with sandboxDevices only.
+func mountDev(dev string) error {
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755,size=64k"); err != nil {
+		return err
+	}
+	for _, name := range sandboxDevices {
+		path := filepath.Join("/dev", name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		target := filepath.Join(dev, name)
+		if err := createFile(target); err != nil {
+			return err
+		}
+		if err := syscall.Mount(path, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	}
+
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NOEXEC)
+	return syscall.Mount("", dev, "", flags, "mode=0755,size=64k")
+}
+
+func createFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+type mount struct {
+	point string
+	flags uintptr
+}
+
+// mountFlags maps the per-mount options of /proc/self/mountinfo
+// to the mount flags.
+var mountFlags = map[string]uintptr{
+	"nosuid":     syscall.MS_NOSUID,
+	"nodev":      syscall.MS_NODEV,
+	"noexec":     syscall.MS_NOEXEC,
+	"noatime":    syscall.MS_NOATIME,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"relatime":   syscall.MS_RELATIME,
+}
+
+// mountsUnder returns the mounts at dir and under it, parents first.
+func mountsUnder(dir string) ([]mount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []mount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		point := unescapeMountPoint(fields[4])
+		if point != dir && !strings.HasPrefix(point, dir+"/") {
+			continue
+		}
+		m := mount{point: point}
+		for _, opt := range strings.Split(fields[5], ",") {
+			m.flags |= mountFlags[opt]
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPoint decodes the octal escapes, e.g. "\040" for space,
+// of the mount point in /proc/self/mountinfo.
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
@@ -0,0 +1,155 @@
+//go:build linux
+// +build linux
+
+package qmd_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pressly/qmd"
+	"github.com/pressly/qmd/config"
+)
+
+func TestSandbox(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("sandbox requires root")
+	}
+
+	// Read-only path with a writable mount in it.
+	shared, err := ioutil.TempDir("", "qmd-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(shared)
+	if err := os.Chmod(shared, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(shared+"/sub", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", shared+"/sub", "tmpfs", 0, "mode=0777"); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(shared+"/sub", syscall.MNT_DETACH)
+
+	// Store dir with QMD's private dir in it.
+	store, err := ioutil.TempDir("", "qmd-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+	if err := os.Chmod(store, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(store+"/qmd/output", 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := config.New("./etc/qmd.conf.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.WorkDir, err = ioutil.TempDir("", "qmd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.StoreDir = store
+	conf.Sandbox = config.SandboxConfig{
+		Enabled:  true,
+		UID:      65534,
+		GID:      65534,
+		ReadOnly: []string{"/bin", "/usr", "/lib", "/lib64", shared},
+	}
+
+	Qmd := &qmd.Qmd{Config: conf}
+
+	script := `id -u; echo ok >$QMD_TMP/file && cat $QMD_TMP/file; test -e /etc || echo hidden
+touch ` + shared + `/sub/file 2>/dev/null || echo read-only
+ls /dev | grep -vxE 'null|zero|full|random|urandom|tty' || echo minimal-dev
+echo ok >$QMD_STORE/file && cat $QMD_STORE/file; test -e $QMD_STORE/qmd/output || echo private`
+	cmd := newTestCmd(t, Qmd, "sandbox", script)
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if e := "65534\nok\nhidden\nread-only\nminimal-dev\nok\nprivate\n"; cmd.CmdOut.String() != e {
+		t.Errorf("expected %q, got %q", e, cmd.CmdOut.String())
+	}
+
+	// Never remove the work dir with the host's directories mounted in it.
+	mounts, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(mounts), conf.WorkDir) {
+		t.Fatalf("sandbox of %v is still mounted", conf.WorkDir)
+	}
+	os.RemoveAll(conf.WorkDir)
+}
+
+func TestSandboxKill(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("sandbox requires root")
+	}
+
+	conf, err := config.New("./etc/qmd.conf.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.WorkDir, err = ioutil.TempDir("", "qmd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(conf.WorkDir)
+	conf.StoreDir = ""
+	conf.KillGrace = 10
+	conf.DB.Backend = "file"
+	conf.DB.Dir = conf.WorkDir + "/db"
+	conf.Queue.Backend = "memory"
+	conf.Sandbox = config.SandboxConfig{
+		Enabled:  true,
+		ReadOnly: []string{"/bin", "/usr", "/lib", "/lib64"},
+	}
+
+	// The sandbox's namespaces are set up by New.
+	app, err := qmd.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.DB.Close()
+
+	// The cmd isn't the init of its PID namespace, so a plain sleep,
+	// without a SIGTERM handler, is stopped by SIGTERM.
+	cmd := newTestCmd(t, app, "sandbox-kill", "echo $$; sleep 30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	cmd.Kill()
+	cmd.Wait()
+	cmd.Cleanup()
+
+	if cmd.Signal != "SIGTERM" {
+		t.Errorf("expected SIGTERM, got %q", cmd.Signal)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("kill took %v", time.Since(start))
+	}
+	if pid := cmd.CmdOut.String(); pid == "1\n" || pid == "" {
+		t.Errorf("expected cmd under init, got pid %q", pid)
+	}
+
+	// The init exits with the cmd.
+	cmd = newTestCmd(t, app, "sandbox-exit", "exit 3")
+	cmd.Run()
+	cmd.Cleanup()
+	if cmd.StatusCode != 3 || cmd.Signal != "" {
+		t.Errorf("expected exit status 3, got %v %q", cmd.StatusCode, cmd.Signal)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package qmd
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/pressly/qmd/config"
+)
+
+type sandbox struct{}
+
+func probeSandbox(conf *config.SandboxConfig) (uintptr, error) {
+	return 0, errors.New("sandbox: supported on linux only")
+}
+
+func (cmd *Cmd) enterSandbox() error {
+	return errors.New("sandbox: supported on linux only")
+}
+
+func (cmd *Cmd) leaveSandbox() {}
+
+func (cmd *Cmd) sandboxSignal() syscall.Signal { return 0 }
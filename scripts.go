@@ -1,13 +1,17 @@
 package qmd
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
-	"reflect"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/goware/lg"
 )
@@ -15,8 +19,26 @@ import (
 type Scripts struct {
 	Running bool
 
-	sync.Mutex                   // guards files
-	files      map[string]string // Map of scripts names to the actual files.
+	// OnChange, if set, is called by Update when the scripts change.
+	OnChange func(change ScriptsChange)
+
+	sync.Mutex                      // guards the fields below
+	files      map[string]string    // Map of scripts names to the actual files.
+	manifests  map[string]*Manifest // Map of scripts names to their manifests.
+	versions   map[string]string    // Map of scripts names to their versions.
+	invalid    map[string]string    // Map of scripts with invalid manifests to their versions.
+}
+
+// ScriptsChange lists scripts added, removed or modified by Update.
+// Change of the script's manifest counts as modification of the script.
+type ScriptsChange struct {
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	Modified []string `json:"modified,omitempty"`
+}
+
+func (c ScriptsChange) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Modified) == 0
 }
 
 // Update walks ScriptDir directory for shell scripts and updates the files cache.
@@ -30,7 +52,11 @@ func (s *Scripts) Update(dir string) error {
 	}
 
 	files := map[string]string{}
+	versions := map[string]string{}
 	if err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if !info.IsDir() {
 			if path.Ext(file) == ".sh" {
 				rel, err := filepath.Rel(dir, file)
@@ -38,6 +64,7 @@ func (s *Scripts) Update(dir string) error {
 					return err
 				}
 				files[rel] = file
+				versions[rel] = scriptVersion(file, info)
 			}
 		}
 		return nil
@@ -45,24 +72,78 @@ func (s *Scripts) Update(dir string) error {
 		return err
 	}
 
+	s.Lock()
+	defer s.Unlock()
+
+	manifests := map[string]*Manifest{}
+	invalid := map[string]string{}
+	for rel, file := range files {
+		m, err := LoadManifest(file)
+		if err != nil {
+			// Don't run the script without the restrictions.
+			if s.invalid[rel] != versions[rel] {
+				lg.Errorf("Scripts:\tIgnoring %v: invalid manifest: %v", rel, err)
+			}
+			invalid[rel] = versions[rel]
+			delete(files, rel)
+			delete(versions, rel)
+			continue
+		}
+		if m != nil {
+			manifests[rel] = m
+		}
+	}
+	s.invalid = invalid
+
 	if len(files) == 0 {
 		return errors.New("script_dir=\"" + dir + "\" is empty")
 	}
 
-	s.Lock()
-	defer s.Unlock()
-
-	if !reflect.DeepEqual(s.files, files) {
-		lg.Debug("Scripts:	Loading new files from script_dir:")
-		for rel, _ := range files {
-			lg.Debugf("Scripts:	 - %v", rel)
+	var change ScriptsChange
+	for rel, version := range versions {
+		old, ok := s.versions[rel]
+		switch {
+		case !ok:
+			change.Added = append(change.Added, rel)
+		case old != version:
+			change.Modified = append(change.Modified, rel)
+		}
+	}
+	for rel := range s.versions {
+		if _, ok := versions[rel]; !ok {
+			change.Removed = append(change.Removed, rel)
 		}
 	}
 
 	s.files = files
+	s.manifests = manifests
+	s.versions = versions
+
+	if !change.Empty() {
+		sort.Strings(change.Added)
+		sort.Strings(change.Removed)
+		sort.Strings(change.Modified)
+		lg.Debugf("Scripts:\tChanged script_dir: added %v, removed %v, modified %v", change.Added, change.Removed, change.Modified)
+		if s.OnChange != nil {
+			go s.OnChange(change)
+		}
+	}
+
 	return nil
 }
 
+// scriptVersion identifies content of the script and its manifest
+// by their mtimes and sizes.
+func scriptVersion(file string, info os.FileInfo) string {
+	version := fmt.Sprintf("%v:%v", info.ModTime().UnixNano(), info.Size())
+	for _, ext := range ManifestExts {
+		if m, err := os.Stat(file + ext); err == nil {
+			version += fmt.Sprintf(";%v:%v:%v", ext, m.ModTime().UnixNano(), m.Size())
+		}
+	}
+	return version
+}
+
 func (s *Scripts) Get(file string) (string, error) {
 	s.Lock()
 	defer s.Unlock()
@@ -73,3 +154,83 @@ func (s *Scripts) Get(file string) (string, error) {
 	}
 	return script, nil
 }
+
+// Manifest returns manifest of the script, or nil if the script
+// has no manifest.
+func (s *Scripts) Manifest(file string) (*Manifest, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.files[file]; !ok {
+		return nil, fmt.Errorf(`script "%v" doesn't exist`, file)
+	}
+	return s.manifests[file], nil
+}
+
+// ScriptInfo describes a script in the catalog.
+type ScriptInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	SHA256   string    `json:"sha256"`
+	Manifest *Manifest `json:"manifest,omitempty"`
+}
+
+// Info returns details of the script.
+func (s *Scripts) Info(file string) (*ScriptInfo, error) {
+	script, err := s.Get(file)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := s.Manifest(file)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(script)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return &ScriptInfo{
+		Name:     file,
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+		SHA256:   hex.EncodeToString(h.Sum(nil)),
+		Manifest: manifest,
+	}, nil
+}
+
+// List returns details of all the scripts, sorted by name.
+func (s *Scripts) List() ([]*ScriptInfo, error) {
+	s.Lock()
+	names := make([]string, 0, len(s.files))
+	for rel := range s.files {
+		names = append(names, rel)
+	}
+	s.Unlock()
+
+	sort.Strings(names)
+
+	list := make([]*ScriptInfo, 0, len(names))
+	for _, name := range names {
+		info, err := s.Info(name)
+		if err != nil {
+			// The script might have been removed meanwhile.
+			continue
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
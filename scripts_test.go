@@ -0,0 +1,178 @@
+package qmd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pressly/qmd"
+	"github.com/pressly/qmd/config"
+)
+
+func TestScriptsUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qmd-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	changes := make(chan qmd.ScriptsChange, 10)
+	scripts := &qmd.Scripts{
+		OnChange: func(change qmd.ScriptsChange) {
+			changes <- change
+		},
+	}
+
+	expectChange := func(expected qmd.ScriptsChange) {
+		select {
+		case change := <-changes:
+			if !reflect.DeepEqual(change, expected) {
+				t.Errorf("expected %+v, got %+v", expected, change)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("expected %+v, got nothing", expected)
+		}
+	}
+
+	ioutil.WriteFile(dir+"/a.sh", []byte("#!/bin/bash\n"), 0755)
+	ioutil.WriteFile(dir+"/b.sh", []byte("#!/bin/bash\n"), 0755)
+	if err := scripts.Update(dir); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(qmd.ScriptsChange{Added: []string{"a.sh", "b.sh"}})
+
+	ioutil.WriteFile(dir+"/a.sh", []byte("#!/bin/bash\necho a\n"), 0755)
+	ioutil.WriteFile(dir+"/b.sh.json", []byte(`{"timeout": 10}`), 0644)
+	os.Mkdir(dir+"/sub", 0755)
+	ioutil.WriteFile(dir+"/sub/c.sh", []byte("#!/bin/bash\n"), 0755)
+	if err := scripts.Update(dir); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(qmd.ScriptsChange{Added: []string{"sub/c.sh"}, Modified: []string{"a.sh", "b.sh"}})
+
+	os.Remove(dir + "/a.sh")
+	if err := scripts.Update(dir); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(qmd.ScriptsChange{Removed: []string{"a.sh"}})
+
+	// No change, no event.
+	if err := scripts.Update(dir); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("unexpected change %+v", change)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestWatchScripts(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("watching script_dir is supported on linux only")
+	}
+
+	dir, err := ioutil.TempDir("", "qmd-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(dir+"/a.sh", []byte("#!/bin/bash\n"), 0755)
+
+	Qmd := &qmd.Qmd{
+		Config: &config.Config{ScriptDir: dir},
+	}
+	go Qmd.WatchScripts()
+
+	waitFor := func(file string) error {
+		var err error
+		for i := 0; i < 50; i++ {
+			if _, err = Qmd.Scripts.Get(file); err == nil {
+				return nil
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return err
+	}
+
+	if err := waitFor("a.sh"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Picked up by the watcher, long before the periodic rescan.
+	ioutil.WriteFile(dir+"/b.sh", []byte("#!/bin/bash\n"), 0755)
+	if err := waitFor("b.sh"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScriptsOnChangeURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qmd-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/scripts", 0755)
+	ioutil.WriteFile(dir+"/scripts/a.sh", []byte("#!/bin/bash\n"), 0755)
+
+	type payload struct {
+		URL string `json:"url"`
+		qmd.ScriptsChange
+	}
+	changes := make(chan payload, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		changes <- p
+	}))
+	defer ts.Close()
+
+	conf := fmt.Sprintf(`url = "http://qmd1:8484"
+script_dir = "%[1]v/scripts"
+work_dir = "%[1]v"
+
+[db]
+backend = "file"
+dir = "%[1]v/db"
+
+[queue]
+backend = "memory"
+
+[scripts]
+on_change_url = "%[2]v"
+`, dir, ts.URL)
+	if err := ioutil.WriteFile(dir+"/qmd.conf", []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.New(dir + "/qmd.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Qmd, err := qmd.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Qmd.DB.Close()
+
+	if err := Qmd.Scripts.Update(c.ScriptDir); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-changes:
+		if p.URL != "http://qmd1:8484" || !reflect.DeepEqual(p.ScriptsChange, qmd.ScriptsChange{Added: []string{"a.sh"}}) {
+			t.Errorf("unexpected change %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected change, got nothing")
+	}
+}
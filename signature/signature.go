@@ -0,0 +1,112 @@
+// Package signature signs QMD callback requests and verifies them
+// on the receiver side.
+//
+// QMD signs the JSON body of the callback POST request with a shared
+// secret (see "secret" in the [callback] config section) and sends
+// the following headers:
+//
+//	X-Qmd-Timestamp: <unix time in seconds>
+//	X-Qmd-Signature: sha256=<hex encoded HMAC-SHA256 of "<timestamp>.<body>">
+//
+// Receivers should verify the callbacks with VerifyRequest:
+//
+//	body, err := signature.VerifyRequest(r, secret, 5*time.Minute)
+//	if err != nil {
+//		http.Error(w, err.Error(), 401)
+//		return
+//	}
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Qmd-Signature"
+	TimestampHeader = "X-Qmd-Timestamp"
+
+	prefix = "sha256="
+)
+
+var (
+	ErrNoSignature      = errors.New("signature: missing " + SignatureHeader + " or " + TimestampHeader + " header")
+	ErrInvalidSignature = errors.New("signature: invalid signature")
+	ErrInvalidTimestamp = errors.New("signature: invalid timestamp")
+	ErrExpired          = errors.New("signature: timestamp outside of the replay window")
+)
+
+// Sign returns signature of the body sent at a given time.
+func Sign(secret []byte, timestamp time.Time, body []byte) string {
+	return prefix + hex.EncodeToString(mac(secret, strconv.FormatInt(timestamp.Unix(), 10), body))
+}
+
+// SignRequest sets the signature headers of the request with a given body.
+func SignRequest(r *http.Request, secret []byte, body []byte) {
+	now := time.Now()
+	r.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	r.Header.Set(SignatureHeader, Sign(secret, now, body))
+}
+
+// Verify checks the signature of the body. The timestamp must not be
+// further than window from now, so the captured requests can't be
+// replayed later.
+func Verify(secret []byte, signature string, timestamp string, body []byte, window time.Duration) error {
+	if signature == "" || timestamp == "" {
+		return ErrNoSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	if d := time.Since(time.Unix(unix, 0)); d > window || d < -window {
+		return ErrExpired
+	}
+
+	if !strings.HasPrefix(signature, prefix) {
+		return ErrInvalidSignature
+	}
+	sum, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal(sum, mac(secret, timestamp, body)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// VerifyRequest reads the request body and verifies its signature.
+// It returns the body, which is also left readable in r.Body.
+func VerifyRequest(r *http.Request, secret []byte, window time.Duration) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	err = Verify(secret, r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), body, window)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func mac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -0,0 +1,54 @@
+package signature_test
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pressly/qmd/signature"
+)
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"id":"1","status":"OK"}`)
+
+	r, _ := http.NewRequest("POST", "http://localhost/callback", bytes.NewReader(body))
+	signature.SignRequest(r, secret, body)
+
+	data, err := signature.VerifyRequest(r, secret, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, body) {
+		t.Errorf(`expected "%s", got "%s"`, body, data)
+	}
+
+	// Wrong secret.
+	if _, err := signature.VerifyRequest(r, []byte("wrong"), time.Minute); err != signature.ErrInvalidSignature {
+		t.Errorf(`expected "%v", got "%v"`, signature.ErrInvalidSignature, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"id":"1","status":"OK"}`)
+
+	past := time.Now().Add(-time.Hour)
+	sig := signature.Sign(secret, past, body)
+	ts := strconv.FormatInt(past.Unix(), 10)
+
+	if err := signature.Verify(secret, sig, ts, body, 2*time.Hour); err != nil {
+		t.Error(err)
+	}
+	if err := signature.Verify(secret, sig, ts, body, time.Minute); err != signature.ErrExpired {
+		t.Errorf(`expected "%v", got "%v"`, signature.ErrExpired, err)
+	}
+	if err := signature.Verify(secret, sig, ts, []byte(`{"id":"1","status":"ERR"}`), 2*time.Hour); err != signature.ErrInvalidSignature {
+		t.Errorf(`expected "%v", got "%v"`, signature.ErrInvalidSignature, err)
+	}
+	if err := signature.Verify(secret, "", "", body, 2*time.Hour); err != signature.ErrNoSignature {
+		t.Errorf(`expected "%v", got "%v"`, signature.ErrNoSignature, err)
+	}
+}
@@ -11,6 +11,9 @@ type SlackNotifier struct {
 	WebhookURL string
 	Channel    string
 	Prefix     string
+
+	// OnError, if set, is called when notification fails.
+	OnError func(err error)
 }
 
 type slackPayload struct {
@@ -19,7 +22,20 @@ type slackPayload struct {
 	Text     string `json:"text"`
 }
 
+// Notify posts msg to the Slack webhook, if there's one configured.
 func (s *SlackNotifier) Notify(msg string) error {
+	if s.WebhookURL == "" {
+		return nil
+	}
+
+	err := s.notify(msg)
+	if err != nil && s.OnError != nil {
+		s.OnError(err)
+	}
+	return err
+}
+
+func (s *SlackNotifier) notify(msg string) error {
 	payload, err := json.Marshal(slackPayload{
 		Channel:  s.Channel,
 		Username: "QMD",
@@ -33,6 +49,7 @@ func (s *SlackNotifier) Notify(msg string) error {
 	if err != nil {
 		return err
 	}
+	resp.Body.Close()
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("couldn't POST to slack webhook %v", s.WebhookURL)
 	}
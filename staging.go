@@ -0,0 +1,258 @@
+package qmd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goware/lg"
+
+	"github.com/pressly/qmd/rest/api"
+)
+
+// FileTooLargeError is returned when the request's files exceed
+// the configured size limits.
+type FileTooLargeError struct {
+	Name  string
+	Max   int64 // In bytes.
+	Total bool  // The total size limit was exceeded.
+}
+
+func (e *FileTooLargeError) Error() string {
+	if e.Total {
+		return fmt.Sprintf("%v: files exceed %v bytes in total", e.Name, e.Max)
+	}
+	return fmt.Sprintf("%v: file exceeds %v bytes", e.Name, e.Max)
+}
+
+// Staging holds the files uploaded with a request until the job runs,
+// so they don't travel in the queue. The worker copies them to QMD_TMP,
+// so they're still there, unchanged, if the job is requeued.
+type Staging struct {
+	ID    string
+	Files []string // Names of the staged files, in order of upload.
+
+	dir      string
+	maxFile  int64
+	maxTotal int64
+	total    int64
+}
+
+// NewStaging prepares a staging directory for the request's files.
+// The directory is created with the first file.
+func (qmd *Qmd) NewStaging() (*Staging, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	s := &Staging{
+		ID:       hex.EncodeToString(id[:]),
+		maxFile:  int64(qmd.Config.Files.MaxFileSize) * 1024 * 1024,
+		maxTotal: int64(qmd.Config.Files.MaxTotalSize) * 1024 * 1024,
+	}
+	s.dir = qmd.stagingDir(s.ID)
+	return s, nil
+}
+
+// AddInline checks the request's inline files against the limits.
+func (s *Staging) AddInline(files map[string]string) error {
+	for name, data := range files {
+		for _, staged := range s.Files {
+			if staged == name {
+				return fmt.Errorf("duplicate file \"%v\"", name)
+			}
+		}
+		if err := s.count(name, int64(len(data))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddStdin checks the request's stdin against the total size limit.
+func (s *Staging) AddStdin(stdin []byte) error {
+	if s.maxTotal > 0 && s.total+int64(len(stdin)) > s.maxTotal {
+		return &FileTooLargeError{Name: "stdin", Max: s.maxTotal, Total: true}
+	}
+	s.total += int64(len(stdin))
+	return nil
+}
+
+// count adds n bytes of the file to the total size.
+func (s *Staging) count(name string, n int64) error {
+	if s.maxFile > 0 && n > s.maxFile {
+		return &FileTooLargeError{Name: name, Max: s.maxFile}
+	}
+	s.total += n
+	if s.maxTotal > 0 && s.total > s.maxTotal {
+		return &FileTooLargeError{Name: name, Max: s.maxTotal, Total: true}
+	}
+	return nil
+}
+
+// Add streams the file to the staging directory. It fails with
+// FileTooLargeError, if the file exceeds the limits.
+func (s *Staging) Add(name string, r io.Reader) error {
+	if !validFileName(name) {
+		return fmt.Errorf("invalid file name \"%v\"", name)
+	}
+	if reservedFileName(name) {
+		return fmt.Errorf("file name \"%v\" is reserved", name)
+	}
+	if s.dir == "" {
+		return errors.New("can't upload files: staging_dir is not set")
+	}
+	for _, staged := range s.Files {
+		if staged == name {
+			return fmt.Errorf("duplicate file \"%v\"", name)
+		}
+	}
+	// Other jobs might see the staging_dir, e.g. in QMD_STORE.
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	s.Files = append(s.Files, name)
+
+	// Read one byte over the limits, so we know they're exceeded.
+	limit := int64(-1)
+	if s.maxFile > 0 {
+		limit = s.maxFile + 1
+	}
+	if s.maxTotal > 0 && (limit < 0 || s.maxTotal-s.total+1 < limit) {
+		limit = s.maxTotal - s.total + 1
+	}
+	if limit >= 0 {
+		r = io.LimitReader(r, limit)
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.count(name, n)
+}
+
+// Remove removes the staged files.
+func (s *Staging) Remove() {
+	if s.dir == "" {
+		return
+	}
+	if err := os.RemoveAll(s.dir); err != nil {
+		lg.Errorf("Staging:\tcan't remove %v: %v", s.dir, err)
+	}
+}
+
+// stagingDir returns the staging directory of the given ID.
+func (qmd *Qmd) stagingDir(ID string) string {
+	dir := qmd.Config.Files.StagingDir
+	if dir == "" && qmd.Config.StoreDir != "" {
+		dir = filepath.Join(privateDir(qmd.Config.StoreDir), "staging")
+	}
+	if dir == "" || !validFileName(ID) {
+		return ""
+	}
+	return filepath.Join(dir, ID)
+}
+
+// removeStaging removes the job's staged files, if any.
+func (qmd *Qmd) removeStaging(ID string) {
+	if ID == "" {
+		return
+	}
+	if dir := qmd.stagingDir(ID); dir != "" {
+		(&Staging{dir: dir}).Remove()
+	}
+}
+
+// sweepStaging removes the staged files of the jobs that never ran.
+func (qmd *Qmd) sweepStaging() {
+	dir := filepath.Dir(qmd.stagingDir("sweep"))
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		if time.Since(info.ModTime()) > time.Duration(logTTL)*time.Second {
+			qmd.removeStaging(info.Name())
+		}
+	}
+}
+
+// copyStaged copies the staged files to the cmd's working directory.
+// They're not linked, so the cmd can't change the staged files.
+func (cmd *Cmd) copyStaged() error {
+	infos, err := ioutil.ReadDir(cmd.StagingDir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if reservedFileName(info.Name()) {
+			return fmt.Errorf("file name \"%v\" is reserved", info.Name())
+		}
+		from := filepath.Join(cmd.StagingDir, info.Name())
+		to := filepath.Join(cmd.Cmd.Dir, info.Name())
+		if err := copyFile(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// Stdin returns the request's stdin, if any.
+func Stdin(req *api.ScriptsRequest) ([]byte, error) {
+	switch {
+	case req.Stdin != "" && req.StdinBase64 != "":
+		return nil, errors.New("stdin and stdin_base64 are mutually exclusive")
+	case req.StdinBase64 != "":
+		stdin, err := base64.StdEncoding.DecodeString(req.StdinBase64)
+		if err != nil {
+			return nil, fmt.Errorf("stdin_base64: %v", err)
+		}
+		return stdin, nil
+	case req.Stdin != "":
+		return []byte(req.Stdin), nil
+	}
+	return nil, nil
+}
+
+// validFileName reports whether the name is a plain file name,
+// which can't escape its directory.
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// reservedFileName reports whether QMD creates the file in QMD_TMP itself.
+func reservedFileName(name string) bool {
+	return name == "QMD_OUT" || name == artifactsDir
+}
@@ -0,0 +1,86 @@
+package qmd
+
+import (
+	"sort"
+
+	"github.com/pressly/qmd/rest/api"
+)
+
+// Stats returns number of the queued, running and finished jobs
+// per priority, and stats of this node's workers and jobs.
+func (qmd *Qmd) Stats() (*api.JobsStats, error) {
+	stats := &api.JobsStats{
+		Queued:   map[string]int{},
+		Running:  map[string]int{},
+		Finished: map[string]int{},
+		Node: api.NodeStats{
+			Scripts:     map[string]*api.ScriptStats{},
+			RunningJobs: []*api.RunningJob{},
+		},
+	}
+
+	var err error
+	for _, priority := range Priorities {
+		if stats.Queued[priority], err = qmd.Queue.Len(priority); err != nil {
+			return nil, err
+		}
+		if stats.Running[priority], err = qmd.Queue.ActiveLen(priority); err != nil {
+			return nil, err
+		}
+		if stats.Finished[priority], err = qmd.DB.FinishedLen(priority); err != nil {
+			return nil, err
+		}
+	}
+	if stats.Total, err = qmd.DB.TotalLen(); err != nil {
+		return nil, err
+	}
+	if stats.Cached, err = qmd.DB.Len(); err != nil {
+		return nil, err
+	}
+
+	busy := qmd.BusyWorkers()
+	stats.Node.Workers = map[string]int{
+		"busy": busy,
+		"idle": qmd.Config.MaxJobs - busy,
+	}
+
+	script := func(name string) *api.ScriptStats {
+		s, ok := stats.Node.Scripts[name]
+		if !ok {
+			s = &api.ScriptStats{}
+			stats.Node.Scripts[name] = s
+		}
+		return s
+	}
+	for name, n := range qmd.Metrics.FinishedJobs() {
+		script(name).Finished = n
+	}
+
+	qmd.muRunning.Lock()
+	for _, cmd := range qmd.running {
+		select {
+		case <-cmd.Started:
+		default:
+			// Not started yet, StartTime isn't set.
+			continue
+		}
+		script(cmd.Script).Running++
+		stats.Node.RunningJobs = append(stats.Node.RunningJobs, &api.RunningJob{
+			ID:        cmd.JobID,
+			Script:    cmd.Script,
+			Priority:  cmd.Priority.String(),
+			StartTime: cmd.StartTime,
+		})
+	}
+	qmd.muRunning.Unlock()
+
+	sort.Sort(byStartTime(stats.Node.RunningJobs))
+
+	return stats, nil
+}
+
+type byStartTime []*api.RunningJob
+
+func (s byStartTime) Len() int           { return len(s) }
+func (s byStartTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStartTime) Less(i, j int) bool { return s[i].StartTime.Before(s[j].StartTime) }
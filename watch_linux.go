@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package qmd
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// dirWatcher notifies about changes in directory trees using inotify.
+// It doesn't tell what has changed; it only sends to Events.
+type dirWatcher struct {
+	fd     int
+	Events chan struct{}
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &dirWatcher{
+		fd:     fd,
+		Events: make(chan struct{}, 1),
+	}
+	go w.read()
+	return w, nil
+}
+
+// AddTree watches dir and all its subdirectories. It's safe to call it
+// again to pick up new subdirectories.
+func (w *dirWatcher) AddTree(dir string) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if _, err := syscall.InotifyAddWatch(w.fd, file, inotifyMask); err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		return nil
+	})
+}
+
+func (w *dirWatcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			close(w.Events)
+			return
+		}
+
+		// Coalesce the events; the reader rescans the whole tree anyway.
+		select {
+		case w.Events <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package qmd
+
+import "errors"
+
+// dirWatcher is not supported on this platform; WatchScripts
+// falls back to periodic rescans.
+type dirWatcher struct {
+	Events chan struct{}
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	return nil, errors.New("watching directories is supported on linux only")
+}
+
+func (w *dirWatcher) AddTree(dir string) error {
+	return nil
+}
@@ -4,14 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"sync/atomic"
 	"time"
 
-	"github.com/goware/disque"
 	"github.com/goware/lg"
 	"github.com/pressly/qmd/rest/api"
 )
 
-type Worker chan *disque.Job
+type Worker chan *Job
+
+// cancelPollInterval is how often the worker checks whether its job
+// was cancelled on another node.
+const cancelPollInterval = time.Second
 
 func (qmd *Qmd) StartWorkers() {
 	lg.Debugf("Starting %v QMD workers", qmd.Config.MaxJobs)
@@ -25,13 +29,23 @@ func (qmd *Qmd) startWorker(id int, workers chan Worker) {
 	defer qmd.WaitWorkers.Done()
 
 	worker := make(Worker)
+	var current *Job
 	for {
+		if current != nil {
+			atomic.AddInt32(&qmd.busyWorkers, -1)
+			qmd.releaseLimit(current)
+			current = nil
+		}
+
 		// Mark this worker as available.
 		workers <- worker
 
 		select {
 		// Wait for a job.
 		case job := <-worker:
+			atomic.AddInt32(&qmd.busyWorkers, 1)
+			current = job
+
 			msg := fmt.Errorf("Worker %v:\tGot \"%v\" job %v/jobs/%v", id, job.Queue, qmd.Config.URL, job.ID)
 			lg.Error(msg)
 			qmd.Slack.Notify(msg.Error())
@@ -40,7 +54,7 @@ func (qmd *Qmd) startWorker(id int, workers chan Worker) {
 			err := json.Unmarshal([]byte(job.Data), &req)
 			if err != nil {
 				qmd.Queue.Ack(job)
-				msg := fmt.Errorf("Worker %v:\tfailed: %v", err)
+				msg := fmt.Errorf("Worker %v:\tfailed: %v", id, err)
 				lg.Error(msg)
 				qmd.Slack.Notify(msg.Error())
 				break
@@ -49,7 +63,7 @@ func (qmd *Qmd) startWorker(id int, workers chan Worker) {
 			script, err := qmd.GetScript(req.Script)
 			if err != nil {
 				qmd.Queue.Ack(job)
-				msg := fmt.Errorf("Worker %v:\tfailed: %v", err)
+				msg := fmt.Errorf("Worker %v:\tfailed: %v", id, err)
 				lg.Error(msg)
 				qmd.Slack.Notify(msg.Error())
 				break
@@ -59,53 +73,139 @@ func (qmd *Qmd) startWorker(id int, workers chan Worker) {
 			cmd, err := qmd.Cmd(exec.Command(script, req.Args...))
 			if err != nil {
 				qmd.Queue.Ack(job)
-				msg := fmt.Errorf("Worker %v:\tfailed: %v", err)
+				msg := fmt.Errorf("Worker %v:\tfailed: %v", id, err)
 				lg.Error(msg)
 				qmd.Slack.Notify(msg.Error())
 				break
 			}
 			cmd.JobID = job.ID
+			cmd.Script = req.Script
+			cmd.Priority = ParsePriority(job.Queue)
+			cmd.Resources = qmd.resources(req.Script)
+			// The user was checked by CreateJob, but it might
+			// have been removed since.
+			cred, err := qmd.Credential(req.Script)
+			if err != nil {
+				msg := fmt.Errorf("Worker %v:\tfailed: %v", id, err)
+				lg.Error(msg)
+				qmd.Slack.Notify(msg.Error())
+				qmd.failJob(job, req, err)
+				break
+			}
+			if cred != nil {
+				cmd.Credential = cred
+			}
 			cmd.CallbackURL = req.CallbackURL
 			cmd.ExtraWorkDirFiles = req.Files
+			cmd.Stdin, _ = Stdin(req) // Validated by CreateJob.
+			cmd.Env = qmd.environ(req.Script, req.Env)
+			if req.Staging != "" {
+				cmd.StagingDir = qmd.stagingDir(req.Staging)
+			}
+
+			// Register the cmd before checking whether the job was
+			// cancelled while in the queue, so a concurrent Cancel()
+			// either finds it running, or has saved the response.
+			qmd.addRunning(cmd)
+			if _, err := qmd.DB.GetResponse(job.ID); err == nil {
+				qmd.removeRunning(cmd)
+				qmd.Queue.Ack(job)
+				lg.Debugf("Worker %v:\tSkipped cancelled job %v", id, job.ID)
+				break
+			}
+
+			// Start with an empty live log; a redelivered job
+			// might have left a partial one behind.
+			if err := qmd.DB.DeleteLog(job.ID); err != nil {
+				lg.Errorf("Worker %v:\tcan't reset log of job %v: %v", id, job.ID, err)
+			}
+			liveLog := NewLiveLog(qmd.DB, job.ID)
+			liveLog.Max = cmd.CmdOut.Max
+			cmd.LogWriter = liveLog
 
 			// Run a job.
 			go cmd.Run()
 			<-cmd.Started
 
-			select {
-			// Wait for the job to finish.
-			case <-cmd.Finished:
+			cancelled := false
+			timedOut := false
 
-			// Or kill it, if it doesn't finish in a specified time.
-			case <-time.After(time.Duration(qmd.Config.MaxExecTime) * time.Second):
-				cmd.Kill()
-				cmd.Wait()
-				cmd.Cleanup()
+			timeout := time.After(qmd.execTime(req))
+			cancelPoll := time.NewTicker(cancelPollInterval)
+		wait:
+			for {
+				select {
+				// Wait for the job to finish.
+				case <-cmd.Finished:
+					break wait
+
+				// Or kill it, if user cancels it.
+				case <-cmd.Cancelled:
+					cancelled = true
+					cmd.Kill()
+					cmd.Wait()
+					break wait
+
+				// The job might have been cancelled on another node.
+				case <-cancelPoll.C:
+					if ok, _ := qmd.DB.JobCancelled(job.ID); ok {
+						cmd.Cancel()
+					}
 
-			// Or kill it, if QMD is closing.
-			case <-qmd.ClosingWorkers:
-				lg.Debugf("Worker %d:\tStopping (busy)", id)
-				cmd.Kill()
+				// Or kill it, if it doesn't finish in a specified time.
+				case <-timeout:
+					timedOut = true
+					cmd.Kill()
+					cmd.Wait()
+					break wait
+
+				// Or kill it, if QMD is closing.
+				case <-qmd.ClosingWorkers:
+					lg.Debugf("Worker %d:\tStopping (busy)", id)
+					cancelPoll.Stop()
+					cmd.Kill()
+					cmd.Cleanup()
+					liveLog.Close()
+					qmd.DB.DeleteLog(job.ID)
+					qmd.removeRunning(cmd)
+					qmd.Queue.Nack(job)
+					msg := fmt.Errorf("Worker %d:\tNACKed job %v/jobs/%v", id, qmd.Config.URL, job.ID)
+					lg.Error(msg)
+					qmd.Slack.Notify(msg.Error())
+					return
+				}
+			}
+			cancelPoll.Stop()
+
+			// Save the artifacts before the working directory is removed.
+			artifacts := qmd.saveArtifacts(cmd, req.Script)
+			if cancelled || timedOut {
 				cmd.Cleanup()
-				qmd.Queue.Nack(job)
-				msg := fmt.Errorf("Worker %d:\tNACKed job %v/jobs/%v", id, qmd.Config.URL, job.ID)
-				lg.Error(msg)
-				qmd.Slack.Notify(msg.Error())
-				return
 			}
 
+			// Flush the live log before saving the response,
+			// so its followers don't miss the end of it.
+			liveLog.Close()
+
 			// Response.
 			resp := api.ScriptsResponse{
-				ID:     job.ID,
-				Script: req.Script,
-				Args:   req.Args,
-				Files:  req.Files,
+				ID:        job.ID,
+				Script:    req.Script,
+				Args:      req.Args,
+				Files:     req.Files,
+				Uploads:   req.Uploads,
+				CreatedBy: req.CreatedBy,
+				Priority:  job.Queue,
+				Timeout:   int(qmd.execTime(req) / time.Second),
 			}
 
 			// "OK" and "ERR" for backward compatibility.
-			if cmd.StatusCode == 0 {
+			switch {
+			case cancelled:
+				resp.Status = "CANCELLED"
+			case cmd.StatusCode == 0:
 				resp.Status = "OK"
-			} else {
+			default:
 				resp.Status = "ERR"
 			}
 
@@ -113,12 +213,34 @@ func (qmd *Qmd) startWorker(id int, workers chan Worker) {
 			resp.Duration = fmt.Sprintf("%f", cmd.Duration.Seconds())
 			resp.QmdOut = cmd.QmdOut.String()
 			resp.ExecLog = cmd.CmdOut.String()
+			resp.Stdout = cmd.Stdout.String()
+			resp.Stderr = cmd.Stderr.String()
+			resp.Lines = cmd.Lines
+			resp.Truncated = cmd.Truncated()
+			resp.Artifacts = artifacts
 			resp.StartTime = cmd.StartTime
+			resp.Signal = cmd.Signal
+			resp.TimedOut = timedOut
+			resp.Cancelled = cancelled
+			resp.LimitsHit = cmd.LimitsHit
 			if cmd.Err != nil {
 				resp.Err = cmd.Err.Error()
 			}
 
-			qmd.DB.SaveResponse(&resp)
+			qmd.Metrics.JobFinished(req.Script, exitStatus(cmd, cancelled, timedOut), cmd.Duration.Seconds())
+
+			// The response saved by Cancel() wins, the job was
+			// cancelled on another node.
+			if err := qmd.SaveResponse(&resp, req.CallbackURL); err == ErrJobFinished {
+				lg.Debugf("Worker %v:\tJob %v was cancelled, dropping its response", id, job.ID)
+			} else if err != nil {
+				lg.Errorf("Worker %v:\tcan't save job %v: %v", id, job.ID, err)
+			}
+			if err := qmd.DB.ExpireLog(job.ID, finishedLogTTL); err != nil {
+				lg.Errorf("Worker %v:\tcan't expire log of job %v: %v", id, job.ID, err)
+			}
+			qmd.removeRunning(cmd)
+			qmd.removeStaging(req.Staging)
 
 			qmd.Queue.Ack(job)
 			msg = fmt.Errorf("Worker %v:\tACKed job %v/jobs/%v", id, qmd.Config.URL, job.ID)
@@ -131,3 +253,132 @@ func (qmd *Qmd) startWorker(id int, workers chan Worker) {
 		}
 	}
 }
+
+// Cancel stops the job. Running job is killed by its worker, queued job
+// is removed from the queue. It returns ErrNotFound if the job is neither
+// running nor queued, or ErrJobFinished if it has finished already.
+//
+// Job running on another node is cancelled through the store; its worker
+// polls for the request every cancelPollInterval and kills the job.
+func (qmd *Qmd) Cancel(ID string) error {
+	if _, err := qmd.DB.GetResponse(ID); err == nil {
+		return ErrJobFinished
+	}
+
+	qmd.muRunning.Lock()
+	cmd, ok := qmd.running[ID]
+	qmd.muRunning.Unlock()
+	if ok {
+		cmd.Cancel()
+		return nil
+	}
+
+	job, err := qmd.Queue.Fetch(ID)
+	if err != nil {
+		return err
+	}
+
+	// The job might be running on another node, or its worker might
+	// have just dequeued it.
+	if err := qmd.DB.CancelJob(ID); err != nil {
+		return err
+	}
+
+	resp := api.ScriptsResponse{
+		ID:        job.ID,
+		Priority:  job.Queue,
+		Status:    "CANCELLED",
+		Cancelled: true,
+		EndTime:   time.Now(),
+	}
+	var req *api.ScriptsRequest
+	if err := json.Unmarshal([]byte(job.Data), &req); err == nil {
+		resp.Script = req.Script
+		resp.Args = req.Args
+		resp.Files = req.Files
+		resp.Uploads = req.Uploads
+		resp.CallbackURL = req.CallbackURL
+		resp.CreatedBy = req.CreatedBy
+	}
+
+	// Save the response before ACK, so it's there for the clients
+	// waiting for the job. If the job has just finished on another
+	// node, its response wins and its worker ACKs it.
+	if err := qmd.SaveResponse(&resp, resp.CallbackURL); err != nil {
+		return err
+	}
+	if req != nil {
+		qmd.removeStaging(req.Staging)
+	}
+	lg.Debugf("Queue:\tCancelled job %v", job.ID)
+	return qmd.Queue.Ack(job)
+}
+
+// failJob saves ERR response of the job that can't be run, and ACKs it.
+func (qmd *Qmd) failJob(job *Job, req *api.ScriptsRequest, err error) {
+	resp := api.ScriptsResponse{
+		ID:          job.ID,
+		Script:      req.Script,
+		Args:        req.Args,
+		Files:       req.Files,
+		Uploads:     req.Uploads,
+		CallbackURL: req.CallbackURL,
+		CreatedBy:   req.CreatedBy,
+		Priority:    job.Queue,
+		Status:      "ERR",
+		Err:         err.Error(),
+		EndTime:     time.Now(),
+	}
+	qmd.Metrics.JobFinished(req.Script, "failed_to_start", 0)
+
+	if err := qmd.SaveResponse(&resp, req.CallbackURL); err != nil {
+		lg.Errorf("Worker:\tcan't save job %v: %v", job.ID, err)
+	}
+	qmd.removeStaging(req.Staging)
+	qmd.Queue.Ack(job)
+}
+
+// exitStatus classifies the finished cmd for the metrics.
+func exitStatus(cmd *Cmd, cancelled bool, timedOut bool) string {
+	switch {
+	case cancelled:
+		return "cancelled"
+	case timedOut:
+		return "timeout"
+	case cmd.State == Failed:
+		return "failed_to_start"
+	case cmd.State == Invalidated:
+		return "invalidated"
+	case cmd.StatusCode == 0:
+		return "ok"
+	}
+	return "err"
+}
+
+// execTime returns max execution time of the job. The timeout is set
+// by CreateJob, jobs queued by older QMD versions fall back to the
+// script's timeout.
+func (qmd *Qmd) execTime(req *api.ScriptsRequest) time.Duration {
+	if req.Timeout > 0 {
+		return time.Duration(req.Timeout) * time.Second
+	}
+	timeout, _ := qmd.Timeout(req.Script, 0)
+	return timeout
+}
+
+// BusyWorkers returns number of workers running a job.
+func (qmd *Qmd) BusyWorkers() int {
+	return int(atomic.LoadInt32(&qmd.busyWorkers))
+}
+
+func (qmd *Qmd) addRunning(cmd *Cmd) {
+	qmd.muRunning.Lock()
+	defer qmd.muRunning.Unlock()
+	qmd.running[cmd.JobID] = cmd
+}
+
+func (qmd *Qmd) removeRunning(cmd *Cmd) {
+	qmd.muRunning.Lock()
+	defer qmd.muRunning.Unlock()
+	delete(qmd.running, cmd.JobID)
+}